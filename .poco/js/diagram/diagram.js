@@ -0,0 +1,21 @@
+// diagram.js draws the Mermaid diagrams PocoCMS leaves in
+// <pre class="mermaid diagram-poco"> elements. It's included only
+// on pages with ```mermaid fenced code blocks, after the copy of
+// Mermaid in .poco/js/vendor, so nothing is fetched from another
+// server.
+//
+// To skip the script entirely, render diagrams to SVG when
+// building the site by naming a local command in the home
+// page's front matter, for example:
+//
+// diagrams:
+//   mermaid: "mmdc -i - -o - -e svg"
+window.addEventListener('load', function () {
+  if (!window.mermaid) {
+    // Leave the diagram source visible
+    return;
+  }
+  var dark = window.matchMedia && window.matchMedia('(prefers-color-scheme: dark)').matches;
+  window.mermaid.initialize({ startOnLoad: false, theme: dark ? 'dark' : 'default' });
+  window.mermaid.run({ querySelector: 'pre.mermaid' });
+});
@@ -0,0 +1,21 @@
+// math.js typesets the TeX math PocoCMS leaves in
+// <span class="math-poco"> and <div class="math-poco math-display">
+// elements on pages with math: true in their front matter.
+// It uses the copy of KaTeX in .poco/js/vendor, which PocoCMS
+// publishes alongside the site, so nothing is fetched from
+// another server. KaTeX is asked for MathML, which current
+// browsers render natively, so it needs no stylesheet or fonts.
+(function () {
+  if (!window.katex) {
+    return;
+  }
+  var elements = document.querySelectorAll('.math-poco');
+  for (var i = 0; i < elements.length; i++) {
+    var e = elements[i];
+    window.katex.render(e.textContent, e, {
+      displayMode: e.classList.contains('math-display'),
+      output: 'mathml',
+      throwOnError: false
+    });
+  }
+})();
@@ -0,0 +1,129 @@
+// search.js runs the search boxes PocoCMS generates with
+// {{ search }} and fills in the results on the search page,
+// using the search-index.json file published with the site.
+// It's included on every page when the home page has
+// search: true in its front matter.
+(function () {
+  var forms = document.querySelectorAll('form.search-poco');
+  var results = document.getElementById('search-results-poco');
+  if (!forms.length && !results) return;
+
+  var indexURL = forms.length ? forms[0].getAttribute('data-index') : '/search-index.json';
+  var index = null;
+  var waiting = [];
+
+  // load() fetches the search index the first time it's needed.
+  function load(fn) {
+    if (index) return fn(index);
+    waiting.push(fn);
+    if (waiting.length > 1) return;
+    fetch(indexURL)
+      .then(function (r) { return r.json(); })
+      .then(function (pages) {
+        index = pages || [];
+        waiting.forEach(function (f) { f(index); });
+        waiting = [];
+      })
+      .catch(function () { waiting = []; });
+  }
+
+  function esc(s) {
+    return String(s).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+  }
+
+  function terms(query) {
+    return query.toLowerCase().split(/\s+/).filter(function (t) { return t.length > 0; });
+  }
+
+  // count() returns how many times term appears in s.
+  function count(s, term) {
+    var n = 0, pos = 0;
+    while ((pos = s.indexOf(term, pos)) >= 0 && n < 10) { n++; pos += term.length; }
+    return n;
+  }
+
+  // search() returns the pages containing every term, best first.
+  // Matches in titles count most, then headings and tags, then text.
+  function search(pages, query) {
+    var ts = terms(query);
+    if (!ts.length) return [];
+    var found = [];
+    pages.forEach(function (p) {
+      var title = p.title.toLowerCase();
+      var headings = (p.headings || []).join(' ').toLowerCase();
+      var tags = (p.tags || []).join(' ').toLowerCase();
+      var text = p.text.toLowerCase();
+      var score = 0;
+      for (var i = 0; i < ts.length; i++) {
+        var s = 10 * count(title, ts[i]) + 5 * count(headings, ts[i]) +
+          5 * count(tags, ts[i]) + count(text, ts[i]);
+        if (s === 0) return;
+        score += s;
+      }
+      found.push({ page: p, score: score });
+    });
+    found.sort(function (a, b) { return b.score - a.score; });
+    return found.map(function (f) { return f.page; });
+  }
+
+  // snippet() returns text around the first match, with matches marked.
+  function snippet(text, query) {
+    var ts = terms(query);
+    var lower = text.toLowerCase();
+    var pos = -1;
+    for (var i = 0; i < ts.length && pos < 0; i++) pos = lower.indexOf(ts[i]);
+    var start = Math.max(0, pos - 60);
+    var s = (start > 0 ? '…' : '') + text.substr(start, 160) + (start + 160 < text.length ? '…' : '');
+    s = esc(s);
+    ts.forEach(function (t) {
+      s = s.replace(new RegExp('(' + esc(t).replace(/[.*+?^${}()|[\]\\]/g, '\\$&') + ')', 'gi'), '<mark>$1</mark>');
+    });
+    return s;
+  }
+
+  function resultsHTML(found, query, max) {
+    if (!found.length) return '<p class="search-none-poco">No results for “' + esc(query) + '”</p>';
+    return '<ul class="search-list-poco">' + found.slice(0, max).map(function (p) {
+      return '<li><a href="' + esc(p.url) + '">' + esc(p.title) + '</a>' +
+        '<p>' + snippet(p.text, query) + '</p></li>';
+    }).join('') + '</ul>';
+  }
+
+  // As you type in a search box, show the top results below it.
+  Array.prototype.forEach.call(forms, function (form) {
+    var input = form.querySelector('input[name=q]');
+    if (!input) return;
+    var list = document.createElement('div');
+    list.className = 'search-dropdown-poco';
+    list.hidden = true;
+    form.appendChild(list);
+    input.addEventListener('input', function () {
+      var query = input.value.trim();
+      if (!query) { list.hidden = true; return; }
+      load(function (pages) {
+        list.innerHTML = resultsHTML(search(pages, query), query, 8);
+        list.hidden = false;
+      });
+    });
+    input.addEventListener('keydown', function (e) {
+      if (e.key === 'Escape') list.hidden = true;
+    });
+    document.addEventListener('click', function (e) {
+      if (!form.contains(e.target)) list.hidden = true;
+    });
+  });
+
+  // On the search page, show all results for ?q=
+  if (results) {
+    var query = (new URLSearchParams(window.location.search).get('q') || '').trim();
+    Array.prototype.forEach.call(forms, function (form) {
+      var input = form.querySelector('input[name=q]');
+      if (input && !input.value) input.value = query;
+    });
+    if (query) {
+      load(function (pages) {
+        results.innerHTML = resultsHTML(search(pages, query), query, 100);
+      });
+    }
+  }
+})();
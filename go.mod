@@ -4,16 +4,19 @@ go 1.18
 
 require (
 	github.com/13rac1/goldmark-embed v0.0.0-20201220231550-e6806f2de66a
+	github.com/alecthomas/chroma v0.10.0
 	github.com/otiai10/copy v1.9.0
+	github.com/tdewolff/minify/v2 v2.12.9
 	github.com/yuin/goldmark v1.4.13
 	github.com/yuin/goldmark-highlighting v0.0.0-20220208100518-594be1970594
-	github.com/yuin/goldmark-meta v1.1.0
 	golang.org/x/exp v0.0.0-20220909182711-5c715a9e8561
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.21.0
+	gopkg.in/yaml.v2 v2.3.0
 )
 
 require (
-	github.com/alecthomas/chroma v0.10.0 // indirect
 	github.com/dlclark/regexp2 v1.4.0 // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
+	github.com/tdewolff/parse/v2 v2.6.8 // indirect
+	golang.org/x/sys v0.17.0 // indirect
 )
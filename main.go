@@ -4,32 +4,57 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	ytembed "github.com/13rac1/goldmark-embed"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
 	cp "github.com/otiai10/copy"
+	"github.com/tdewolff/minify/v2"
+	mincss "github.com/tdewolff/minify/v2/css"
+	minhtml "github.com/tdewolff/minify/v2/html"
+	minjs "github.com/tdewolff/minify/v2/js"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark-highlighting"
-	"github.com/yuin/goldmark-meta"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer"
 	"github.com/yuin/goldmark/renderer/html"
 	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"golang.org/x/exp/slices"
+	"golang.org/x/image/draw"
+	xhtml "golang.org/x/net/html"
+	"gopkg.in/yaml.v2"
+	htmlstd "html"
 	"html/template"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // IMPORTANT: This is the same name as used in the go:embed directive
@@ -50,6 +75,29 @@ const jsUserLastDir = "userlast"
 // user, meaning user gets the last word)
 const jsPocoLastDir = "last"
 
+// Name of directory under jsDir holding the
+// Javascript that typesets math on pages with
+// math: true in the front matter
+const jsMathDir = "math"
+
+// Name of directory under jsDir holding third-party
+// libraries, such as KaTeX and Mermaid, that are published as
+// separate files instead of being inlined
+const jsVendorDir = "vendor"
+
+// Name of directory under jsDir holding the
+// Javascript that draws Mermaid diagrams on
+// pages containing them
+const jsDiagramDir = "diagram"
+
+// Name of directory under jsDir holding the
+// Javascript for site search
+const jsSearchDir = "search"
+
+// Name of directory, in the project root or in a theme,
+// holding the templates shortcodes expand to.
+const partialsDir = "partials"
+
 // Used to prevent use of a page layout elment. So to
 // prevent a header being dispallyed on the current page,
 // you'd add this to hour front matter:
@@ -81,23 +129,7 @@ func (c *config) scriptAfter() string {
 	// NOTE: Make sure the final } gets inserted
 	// before the closing </code> tag
 
-	return c.pocoEndJs() + c.endJs()
-
-	slice := fmStrSlice("scriptafter", c.fm)
-	if slice == nil {
-		return ""
-	}
-	// Return value
-	scripts := "<script>\n" + "\t" + "function docReady() {\n\t"
-	var s string
-
-	for _, value := range slice {
-		filename := value
-		s = s + c.getWebOrLocalFileStr(filename)
-	}
-	scripts += s + "}\n" + "</script>" + "\n"
-	return scripts
-
+	return c.pocoEndJs() + c.mathJs() + c.diagramJs() + c.searchJs() + c.endJs()
 }
 
 // assemble takes the raw converted HTML in article,
@@ -115,34 +147,180 @@ func (c *config) assemble(filename string) string {
 
 	// Get Javascript that goes just before last body tag
 	scriptAfter := c.scriptAfter()
-	// Build the completed HTML document froe the component pieces.
-	htmlFile = docType + "\"" + c.lang + "\">" + "\n" +
-		"<head>" +
-		"\n\t<meta charset=\"utf-8\">" +
-		"\n\t<meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\">\n" +
-		c.titleTag() +
-		c.metatags() +
-		c.linktags() +
-		c.importRules() +
-		c.stylesheets() +
-		c.styleTags() +
-		"</head>\n<body>" +
-		c.header() +
-		"\n\t" + c.nav() +
-		"\n\t" + c.aside() +
-		c.article() +
-		c.footer() + "\n" +
-		"<script> {" + "\n" +
-		c.documentReady() +
-		scriptAfter +
-		"}\n</script>" + "\n" +
-		"</body>\n</html>\n"
+	// Collect the component pieces for the layout template.
+	data := layoutData{
+		Lang:     c.currentLang(),
+		Title:    fmStr("title", c.fm),
+		Filename: filename,
+		Head: template.HTML(c.titleTag() +
+			c.metatags() +
+			c.canonicalTag() +
+			c.hreflangTags() +
+			c.socialTags() +
+			c.jsonLD() +
+			c.linktags() +
+			c.importRules() +
+			c.stylesheets() +
+			c.styleTags()),
+		Top:     template.HTML(c.regions("top")),
+		Header:  template.HTML(c.header()),
+		Nav:     template.HTML(c.nav()),
+		Aside:   template.HTML(c.aside()),
+		Before:  template.HTML(c.regions("before")),
+		Article: template.HTML(c.article()),
+		After:   template.HTML(c.regions("after")),
+		Footer:  template.HTML(c.footer()),
+		Bottom:  template.HTML(c.regions("bottom")),
+		Regions: c.regionsByName(),
+		Scripts: template.HTML(c.vendorScripts() +
+			"<script> {" + "\n" +
+			c.documentReady() +
+			scriptAfter +
+			"}\n</script>" + "\n"),
+		Menus:       c.currentMenus(),
+		Languages:   c.languageLinks(),
+		Breadcrumbs: c.breadcrumbItems(),
+		Prev:        c.prevPage(),
+		Next:        c.nextPage(),
+		TOC:         c.tocTree(),
+		Lastmod:     c.pageLastmod(c.currentRel()),
+		GitInfo:     c.gitInfoFor(),
+		Page:        c.pageFm,
+		Site:        c.globalFm,
+	}
+	// Build the completed HTML document from the component pieces,
+	// using the theme's layout.html if it has one.
+	layout := defaultLayout
+	if t := c.activeTheme(); t != nil && t.layout != "" {
+		layout = t.layout
+	}
+	if htmlFile, err = c.executeLayout(layout, data); err != nil {
+		quit(1, err, c, "%v: layout template error", filename)
+	}
 	// TODO: This has code smell. Why doesn't it have to be
 	// done for other page layout elements?
 	c.articleReplaced = ""
 	return htmlFile
 } //   assemble
 
+// layoutData holds the rendered pieces of a page. It's
+// what a theme's layout.html template receives, so
+// a layout could look something like this:
+//
+//	<!DOCTYPE html>
+//	<html lang="{{.Lang}}">
+//	<head>{{.Head}}</head>
+//	<body class="{{.Page.bodyclass}}">
+//	{{.Header}}
+//	<main>{{.Article}}</main>
+//	{{.Footer}}
+//	{{.Scripts}}
+//	</body>
+//	</html>
+type layoutData struct {
+	// Value for <html lang=>
+	Lang string
+
+	// Page title from the front matter, unescaped
+	Title string
+
+	// Name of the Markdown source file
+	Filename string
+
+	// Everything that normally goes inside <head>:
+	// title tag, metatags, link tags, import rules,
+	// stylesheets, and style tags
+	Head template.HTML
+
+	// Page layout elements, already converted
+	Header  template.HTML
+	Nav     template.HTML
+	Aside   template.HTML
+	Article template.HTML
+	Footer  template.HTML
+
+	// Theme regions grouped by position
+	Top    template.HTML
+	Before template.HTML
+	After  template.HTML
+	Bottom template.HTML
+
+	// Theme regions by name, for layouts that
+	// place them individually, e.g. {{.Regions.hero}}
+	Regions map[string]template.HTML
+
+	// The <script> block that goes before </body>
+	Scripts template.HTML
+
+	// Menus keyed by name, with the current page marked active
+	Menus map[string][]menuEntry
+
+	// Language switcher for multilingual sites
+	Languages []languageLink
+
+	// Trail from the home page to this page, and the
+	// previous and next pages in its section, if any
+	Breadcrumbs []menuEntry
+	Prev        *menuEntry
+	Next        *menuEntry
+
+	// Table of contents for this page, nested by heading level
+	TOC []*tocEntry
+
+	// When the page last changed, and its last commit if the
+	// project is in a git repository. See GIT UTILITIES.
+	Lastmod time.Time
+	GitInfo *gitInfo
+
+	// Front matter for this page
+	Page map[string]interface{}
+
+	// Front matter for the home page, which holds
+	// sitewide settings
+	Site map[string]interface{}
+}
+
+// defaultLayout is used when a theme doesn't supply its own
+// layout.html. It's how Poco has always put the pieces together.
+var defaultLayout = docType + `"{{.Lang}}">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+{{.Head}}</head>
+<body>{{.Top}}{{.Header}}
+	{{.Nav}}
+	{{.Aside}}{{.Before}}{{.Article}}{{.After}}{{.Footer}}{{.Bottom}}
+{{.Scripts}}</body>
+</html>
+`
+
+// executeLayout() runs the layout template against data
+// and returns the completed HTML document.
+func (c *config) executeLayout(layout string, data layoutData) (string, error) {
+	tmpl, err := template.New("layout").Funcs(c.funcs).Parse(layout)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// activeTheme() returns the theme used for the current page:
+// the page theme if there is one, otherwise the global theme.
+// Returns nil if the page has no theme at all.
+func (c *config) activeTheme() *theme {
+	if c.pageTheme.present {
+		return &c.pageTheme
+	}
+	if c.theme.present {
+		return &c.theme
+	}
+	return nil
+}
+
 func (c *config) timestamp() string {
 	// If it's the home page, and a timestamp was requested,
 	// insert it in a paragraph at the top of the article.
@@ -167,27 +345,13 @@ func (c *config) article() string {
 // THEME
 
 // getFm takes Markdown filename passed in, opens that file,
-// and returns its front matter. The way Goldmark works it
-// means it was necessary to parse and convert the Markdown
-// too, but that just gets discarded.
+// and returns its front matter. Only the front matter is
+// parsed, with parseFrontMatter(); the Markdown isn't
+// converted until the page is built.
 // c.fm is left untouched.
 func (c *config) getFm(filename string) map[string]interface{} {
-	var rawHTML string
-	var err error
-	newC := newConfig()
-
-	// Convert Markdown file, possibly with front matter, to HTML
-	if rawHTML, err = mdYAMLFileToHTMLString(newC, filename); err != nil {
-		quit(1, err, c, "Problem converting %s to HTML", filename)
-	}
-
-	// Execute its templates.
-	if _, err = doTemplate("", rawHTML, newC); err != nil {
-		quit(1, err, c, "%v: Unable to execute ", filename)
-	}
-
-	// And return a new front matter object
-	return newC.fm
+	fm, _ := parseFrontMatter(fileToBuf(filename))
+	return fm
 }
 
 // HTML UTILITIES
@@ -237,8 +401,14 @@ func (c *config) copyFileSlice(source string, targetDir string) string {
 	files := ""
 	s := ""
 	for _, filename := range filenames {
-		path := filepath.Join(targetDir, filename)
-		s = c.fileToString(path)
+		// Scripts can also be named by URL. They're downloaded
+		// and cached like remote stylesheets.
+		if strings.HasPrefix(filename, "http") {
+			s = c.downloadTextFile(filename)
+		} else {
+			path := filepath.Join(targetDir, filename)
+			s = c.fileToString(path)
+		}
 		files = files + s
 	}
 	return files
@@ -262,24 +432,8 @@ func (c *config) pocoEndJs() string {
 // - "foobar.js"
 // - "yomama.js"
 // ---
-//
 func (c *config) endJs() string {
 	return c.copyFileSlice("endjs", c.jsUserLastDir)
-	filenames := fmStrSlice("endjs", c.fm)
-	if len(filenames) == 0 {
-		return ""
-	}
-	files := ""
-	s := ""
-	for _, value := range filenames {
-		filename := value
-		s = s + c.getWebOrLocalFileStr(filename)
-		/* path := filepath.Join(c.jsUserLastDir, filename)
-		   s = c.fileToString(path)
-		   files = files + s
-		*/
-	}
-	return files
 }
 
 // defaultHomePage() Generates a simple home page as an HTML string
@@ -342,6 +496,14 @@ type theme struct {
 	burger        string
 	hamburgerIcon string
 
+	// Name of a menu used to generate the hamburger menu
+	// instead of a burger file, e.g. burgermenu: main
+	burgerMenu string
+
+	// Name of a menu used to generate the nav
+	// instead of a nav file, e.g. navmenu: main
+	navMenu string
+
 	// If true, don't insert article into output stream
 	articleHidden bool
 
@@ -381,6 +543,17 @@ type theme struct {
 	// If true, don't insert footer into output stream
 	footerHidden bool
 
+	// Page layout elements beyond header, nav, aside, and footer
+	regions []region
+
+	// Contents of the theme's layout.html template, if any.
+	// Empty means use defaultLayout.
+	layout string
+
+	// Syntax highlighting settings from highlight:
+	// in the front matter. See highlightSettings().
+	highlight map[string]string
+
 	// List of rules to import
 	importRuleNames []string
 	importRulesStr  string
@@ -419,6 +592,73 @@ type theme struct {
 	ver string
 }
 
+// region is a page layout element declared by a theme
+// beyond the built-in header, nav, aside, and footer,
+// for example a hero banner or call-to-action strip.
+// Regions are listed in the theme's README.md front matter:
+//
+// ---
+// regions:
+//   - name: hero
+//     tag: section
+//     file: hero.md
+//     position: before
+//
+// ---
+//
+// A page can override a region's file the same way it
+// overrides a header, by naming it in the front matter
+// (hero: "other-hero.md"), or hide it with hide: hero.
+// That's why a region can't share its name with a built-in
+// layout element or any other front matter key Poco reads,
+// such as menu or toc. See frontMatterKeys.
+//
+// Regions follow the same rule as the built-in layout
+// elements: a Markdown file is wrapped in the region's tag,
+// but an HTML file is used as is, so it supplies its own
+// tag, for example <section id="hero-poco">...</section>
+type region struct {
+	// Front matter key used for overrides and hide:
+	name string
+
+	// HTML tag to wrap a Markdown region in. Defaults to div.
+	tag string
+
+	// id attribute of the tag. Defaults to {name}-poco.
+	id string
+
+	// Where the region appears relative to the other
+	// layout elements: "top" (before the header),
+	// "before" (just before the article), "after" (just
+	// after the article), or "bottom" (after the footer).
+	// Defaults to "before".
+	position string
+
+	// Markdown or HTML file for the region's contents
+	filename string
+
+	// Holds converted and template-parsed source for the region
+	html string
+}
+
+// Valid values for region.position
+var regionPositions = []string{"top", "before", "after", "bottom"}
+
+// frontMatterKeys lists the front matter keys Poco reads
+// from a page or the home page. Region names can't be
+// any of them, because a page overrides a region by
+// naming a file under the region's name.
+var frontMatterKeys = []string{"aliases", "article", "aside", "attributes",
+	"author", "baseurl", "branding", "burger", "burgericon", "burgermenu",
+	"csp", "date", "description", "diagrams", "endjs", "footer", "header",
+	"hide", "highlight", "ignore", "image", "images", "importrules",
+	"keywords", "languages", "layout", "lazy", "linktags", "math", "menu",
+	"menutitle", "modified", "nav", "navmenu", "notfound", "pagetheme",
+	"quality", "redirects", "regions", "remotehosts", "robots", "safehtml",
+	"schematype", "schemes", "search", "sidebar", "sitename", "sizes",
+	"styles", "stylesheets", "supportedfeatures", "tags", "theme", "title",
+	"toc", "tocmax", "tocmin", "twitter", "ver", "weight"}
+
 // TODO: Doc
 
 // there are no configuration files (yet) but this holds
@@ -448,6 +688,17 @@ type config struct {
 	// dumpfm command-line option shows the front matter of each page
 	dumpFm bool
 
+	// Files being included with the include or code shortcodes,
+	// innermost last, for detecting include cycles
+	includeStack []string
+
+	// Resized images to publish, keyed by their
+	// full pathnames in the webroot
+	imageVariants map[string]imageVariant
+
+	// Every page in the search index, if search is on
+	searchIndex []searchEntry
+
 	// Directory holding user-supplied source files to read in at bottom of
 	// script tag area
 	jsUserLastDir string
@@ -459,12 +710,47 @@ type config struct {
 	// linkStylesOption true means stylesheets will not be inlined.
 	linkStylesOption bool
 
+	// Command-line flag -bundle-styles links every page to a shared,
+	// fingerprinted stylesheet file instead of inlining stylesheets
+	bundleStylesFlag bool
+
+	// Stylesheet bundles to publish, keyed by their full
+	// pathnames in the webroot
+	bundles map[string]string
+
+	// Files published under assets, such as those referred to
+	// by stylesheet bundles and the libraries in .poco/js/vendor,
+	// keyed by their full pathnames in the webroot. Values are
+	// the source files.
+	bundleAssets map[string]string
+
 	// List of all files being processed
 	files []string
 
+	// Every Markdown page in the project with its front matter,
+	// collected before any pages are built
+	pages []pageInfo
+
+	// Files included by each page, keyed by the page's
+	// full pathname. The page counts as changed when
+	// one of them changes. See pageLastmod().
+	dependencies map[string][]string
+
+	// Pages in each section, in order, keyed by language
+	// and directory. See siblings().
+	sections map[string][]pageInfo
+
+	// Menus built from the pages' front matter or from
+	// the menus: list on the home page, keyed by menu name
+	menus map[string][]menuEntry
+
 	// All built-in functions must appear here to be publicly available
 	funcs map[string]interface{}
 
+	// Every heading in the current page, in order,
+	// for the table of contents
+	headings []heading
+
 	// Front matter
 	// front matter for current theme
 	fm map[string]interface{}
@@ -475,6 +761,10 @@ type config struct {
 	// front matter for current page
 	pageFm map[string]interface{}
 
+	// Last commit to change each file, keyed by its
+	// slash-separated path relative to c.root
+	gitLog map[string]*gitInfo
+
 	// Fully qualified pathname for the .poco directory
 	pocoDir string
 
@@ -488,11 +778,55 @@ type config struct {
 	// Command-line flag -lang sets the language of the HTML files
 	lang string
 
+	// Language codes from languages: on the home page, default
+	// first. Empty unless the site is multilingual.
+	languages []string
+
+	// Translated UI strings from i18n/<lang>.yaml, keyed by language
+	translations map[string]map[string]string
+
 	// markdownExtensions are how PocoCMS figures out whether
 	// a file is Markdown. If it ends in any one of these then
 	// it gets converted to HTML.
 	markdownExtensions searchInfo
 
+	// Command-line flag -minify strips comments and whitespace
+	// from pages, stylesheets, and Javascript
+	minifyFlag bool
+
+	// Sizes of everything minified, for the report at the end
+	minified minifyStats
+
+	// Command-line flag -offline uses only cached copies
+	// of remote files instead of downloading them
+	offlineFlag bool
+
+	// Contents of remote files fetched during this build, keyed by URL
+	downloads map[string]string
+
+	// Command-line flag -timeout sets how long to wait
+	// for a remote file to download
+	timeout time.Duration
+
+	// Command-line flag -lock saves the hashes of remote
+	// files to .poco/integrity.json
+	lockFlag bool
+
+	// Subresource Integrity hashes of remote files fetched
+	// during this build, keyed by URL
+	integrity map[string]string
+
+	// Expected hashes of remote files, keyed by URL. See pinnedHashes().
+	pins map[string]string
+
+	// Command-line flag -csp adds a Content-Security-Policy
+	// to pages: meta, headers, or both
+	csp string
+
+	// Content-Security-Policy for each page, keyed by URL,
+	// for the _headers file
+	cspPolicies map[string]string
+
 	// Command-line flag -new generates a new project by this name
 	newProjectFlag bool
 	//newProjectStr string
@@ -549,6 +883,10 @@ type config struct {
 	// top of the article when true
 	timestampFlag bool
 
+	// Command-line flag -upgrade merges the .poco directory
+	// embedded in this executable into the project's .poco
+	upgradeFlag bool
+
 	// The --verbose flag. It shows progress as the site is created.
 	// Required by the verbose() function.
 	verboseFlag bool
@@ -754,7 +1092,6 @@ func (c *config) nav() string {
 // - [PocoCMS](https://pococms.com)
 // - [Docs](/docs)
 // - [About](/about.html)
-//
 func (t *theme) hamburgerToHTML(fm map[string]interface{}) {
 
 	filename := fmStr("burger", fm)
@@ -781,15 +1118,22 @@ func (t *theme) hamburgerToHTML(fm map[string]interface{}) {
 	// Convert the hamburger menu to HTML, adding some code
 	// rquired to make the specialized CSS work.
 	links = mdYAMLStringToTemplatedHTMLString(tmpConfig, "", links)
+	t.burger = t.burgerHTML(links)
+	return
+
+}
+
+// burgerHTML() takes the hamburger menu's list of links
+// as HTML and adds the code required to make the specialized
+// burger CSS work.
+func (t *theme) burgerHTML(links string) string {
 	links = "\n" +
 		"<label for=\"hamburger\">" + t.hamburgerIcon + "</label>" + "\n" +
 		`<input type="checkbox" id="hamburger"/>` + "\n" +
 		links
 
-		// Convert it to a header tag but with a bespoke id value
-	t.burger = "<header id=\"header-poco-burger\">" + links + "</header>\n"
-	return
-
+	// Convert it to a header tag but with a bespoke id value
+	return "<header id=\"header-poco-burger\">" + links + "</header>\n"
 }
 
 // header() returns the header defined for this theme, if any.
@@ -953,6 +1297,19 @@ func (c *config) layoutElement(tag string, t *theme) {
 				filename = t.navFilename
 			}
 		}
+		// No nav file, but the page or theme asked for
+		// a menu. Example front matter:
+		// ---
+		// navmenu: "main"
+		// ---
+		menu := fmStr("navmenu", c.pageFm)
+		if menu == "" {
+			menu = t.navMenu
+		}
+		if filename == "" && menu != "" {
+			t.nav = addPocoTag(tag, string(c.menuHTML(menu)))
+			return
+		}
 	case "aside":
 		override := fmStr(tag, c.pageFm)
 		if override != "" {
@@ -996,6 +1353,17 @@ func (c *config) layoutElement(tag string, t *theme) {
 	if path.Ext(filename) == ".html" {
 		if fileExists(filename) {
 			s = c.fileToString(filename)
+			if b, err := c.expandShortcodes([]byte(s)); err != nil {
+				quit(1, err, c, "%s: shortcode error", filename)
+			} else {
+				s = string(b)
+			}
+			// With safehtml: on, HTML files are sanitized
+			// whether it's strip or sanitize.
+			if safe := c.safeHTML(); safe != nil {
+				s = safe.sanitize(s)
+				c.reportViolations(filename, safe)
+			}
 		} else {
 			quit(1, nil, c, "HTML theme layout file %s not found", filename)
 		}
@@ -1011,6 +1379,7 @@ func (c *config) layoutElement(tag string, t *theme) {
 			s = addPocoTag(tag, s)
 		}
 	}
+	s = c.renderDiagrams(s)
 
 	switch tag {
 	case "article":
@@ -1032,7 +1401,162 @@ func (c *config) layoutElement(tag string, t *theme) {
 // <header id="header-poco">Headname</header>
 // code is HTML that needs to appear between the tags
 func addPocoTag(tag, code string) string {
-	return "\n<" + tag + " id=\"" + tag + "-poco" + "\"" + ">" + code + "</" + tag + ">"
+	return addRegionTag(tag, tag+"-poco", code)
+}
+
+// addRegionTag is like addPocoTag but lets the caller
+// choose the id, so addRegionTag("section", "hero-poco", code)
+// returns <section id="hero-poco">code</section>
+func addRegionTag(tag, id, code string) string {
+	return "\n<" + tag + " id=\"" + id + "\"" + ">" + code + "</" + tag + ">"
+}
+
+// layoutRegion() is the counterpart of layoutElement() for
+// regions declared by a theme. It converts the region's file,
+// or the file named for it in the page's front matter,
+// and stores the result in r.html.
+func (c *config) layoutRegion(r *region, t *theme) {
+	r.html = ""
+
+	// See if the user chose to hide this region
+	if c.hidden(r.name) {
+		return
+	}
+
+	// Was the region overridden on this page?
+	// Example front matter:
+	// ---
+	// hero: "newhero.md"
+	// ---
+	filename := r.filename
+	override := fmStr(r.name, c.pageFm)
+	switch override {
+	case suppressToken:
+		return
+	case "":
+		if filename != "" {
+			filename = regularize(t.dir, filename)
+		}
+	default:
+		filename = override
+	}
+	if filename == "" {
+		return
+	}
+
+	s := ""
+	// If HTML file specified read it in.
+	// Like a layout element's HTML file, it supplies its own tag.
+	if path.Ext(filename) == ".html" {
+		if !fileExists(filename) {
+			quit(1, nil, c, "HTML region file %s not found", filename)
+		}
+		b, err := c.expandShortcodes(fileToBuf(filename))
+		if err != nil {
+			quit(1, err, c, "%s: shortcode error", filename)
+		}
+		s = string(b)
+		// Sanitized like layout element HTML files
+		if safe := c.safeHTML(); safe != nil {
+			s = safe.sanitize(s)
+			c.reportViolations(filename, safe)
+		}
+	} else {
+		var err error
+		s = convertMdYAMLFileToHTMLFragmentStr(filename, c)
+		if s, err = doTemplate("", s, c); err != nil {
+			quit(1, err, c, "Unable to parse templates in %s", filename)
+		}
+		if s != "" {
+			s = addRegionTag(r.tag, r.id, s)
+		}
+	}
+	r.html = c.renderDiagrams(s)
+}
+
+// regions() returns the custom regions of the current theme
+// that belong at position, in the order the theme declared them.
+func (c *config) regions(position string) string {
+	t := c.activeTheme()
+	if t == nil {
+		return ""
+	}
+	s := ""
+	for _, r := range t.regions {
+		if r.position == position && r.html != "" {
+			s += r.html + "\n"
+		}
+	}
+	return s
+}
+
+// regionsByName() returns the converted custom regions
+// of the current theme keyed by region name.
+func (c *config) regionsByName() map[string]template.HTML {
+	regions := map[string]template.HTML{}
+	if t := c.activeTheme(); t != nil {
+		for _, r := range t.regions {
+			regions[r.name] = template.HTML(r.html)
+		}
+	}
+	return regions
+}
+
+// getLayout() reads the theme's HTML layout template. It's
+// named in the front matter like this:
+// ---
+// layout: "layout.html"
+// ---
+// If it isn't named, a layout.html file in the theme
+// directory is used if present.
+func (t *theme) getLayout(fm map[string]interface{}) {
+	t.layout = ""
+	filename := fmStr("layout", fm)
+	if filename == "" {
+		filename = "layout.html"
+		if !fileExists(filepath.Join(t.dir, filename)) {
+			return
+		}
+	}
+	filename = regularize(t.dir, filename)
+	if !fileExists(filename) {
+		quit(1, nil, nil, "Can't find layout file %s for theme %s", filename, t.dir)
+	}
+	t.layout = string(fileToBuf(filename))
+}
+
+// getRegions() reads the regions: list from a theme's front matter.
+func (t *theme) getRegions(fm map[string]interface{}) {
+	t.regions = nil
+	for _, m := range fmMapSlice("regions", fm) {
+		r := region{
+			name:     strings.ToLower(m["name"]),
+			tag:      m["tag"],
+			id:       m["id"],
+			position: m["position"],
+			filename: m["file"],
+		}
+		if r.name == "" {
+			quit(1, nil, nil, "Theme %s has a region without a name", t.dir)
+		}
+		if slices.Contains(frontMatterKeys, r.name) {
+			quit(1, nil, nil, "Theme %s: region name %s is reserved for front matter", t.dir, r.name)
+		}
+		if r.tag == "" {
+			r.tag = "div"
+		}
+		if r.id == "" {
+			r.id = r.name + "-poco"
+		}
+		if r.position == "" {
+			r.position = "before"
+		}
+		if !slices.Contains(regionPositions, r.position) {
+			quit(1, nil, nil, "Theme %s: region %s has unknown position %s. Use one of %v",
+				t.dir, r.name, r.position, regionPositions)
+		}
+		t.regions = append(t.regions, r)
+	}
 }
 
 // setupGlobals() sets sitewide values such as
@@ -1048,7 +1572,7 @@ func (c *config) setupGlobals() { //
 	c.markdownExtensions.list = []string{".md", ".mkd", ".mdwn", ".mdown", ".mdtxt", ".mdtext", ".markdown"}
 
 	// Set defaults for files and dirs to skip
-	c.skip = "node_modules .git .DS_Store .gitignore " + pocoDir
+	c.skip = "node_modules .git .DS_Store .gitignore " + pocoDir + " " + partialsDir
 
 	// Determine output directory for all HTML and assets (webroot)
 	c.setWebroot()
@@ -1081,6 +1605,16 @@ func (c *config) setupGlobals() { //
 	//	quit(1, nil, c, "No valid PocoCMS project at %s. Quitting.", c.root)
 	//}
 
+	// Find out whether the site is multilingual before
+	// working out where pages are published.
+	c.loadLanguages()
+
+	// Read the front matter of every page up front so
+	// menus can list pages that haven't been built yet.
+	c.loadGitLog()
+	c.collectPages()
+	c.currentFilename = c.homePage
+
 	// Convert home page to HTML
 	c.homePageStr, _ = buildFileToTemplatedString(c, c.currentFilename)
 
@@ -1118,6 +1652,8 @@ func (c *config) styleTags() string {
 		t = t + "article{float:right;clear:right;}\naside{float:left;}"
 	}
 
+	t = t + c.highlightCSS()
+
 	if t != "" {
 		t = "\n" + tagSurround("style", t, "\n")
 	}
@@ -1153,7 +1689,6 @@ func (c *config) getStyleTags(fm map[string]interface{}) string {
 //
 // NOTE:
 // They must appear above all style rules
-//
 func sliceToImportsRulesStr(importRuleNames []string) string {
 	if len(importRuleNames) <= 0 {
 		return ""
@@ -1264,6 +1799,17 @@ func sliceToStylesheetStr(dir string, sheets []string) string {
 // See also linkStylesheets(), which links to stylesheet
 // instead of inserting directly into the HTML document
 func (c *config) inlineStylesheets(dir string) string {
+	if css := c.themeCSS(dir); css != "" {
+		return "<style>\n" + css + "</style>" + "\n"
+	}
+	return ""
+}
+
+// themeCSS() returns the code for all the stylesheets used by
+// the current page concatenated into one string: those of the
+// page theme or global theme, followed by any stylesheets
+// named in the front matter.
+func (c *config) themeCSS(dir string) string {
 	overrides := ""
 	// Return value
 	s := ""
@@ -1284,7 +1830,7 @@ func (c *config) inlineStylesheets(dir string) string {
 			// If the file is local, read it in.
 			// If it's at a URL, download it.
 			// For debugging purposes, add commment with filename
-			s = "\n\n/* " + filename + " */\n" + c.getWebOrLocalFileStr(fullPath)
+			s = "\n\n/* " + filename + " */\n" + c.stylesheetStr(fullPath)
 			overrides = overrides + s + "\n"
 		}
 	}
@@ -1312,12 +1858,12 @@ func (c *config) inlineStylesheets(dir string) string {
 			s = "\n/* " + filepath.Base(filename) + "*/\n" +
 				// If the file is local, read it in.
 				// If it's at a URL, download it.
-				c.getWebOrLocalFileStr(fullPath)
+				c.stylesheetStr(fullPath)
 			stylesheets = stylesheets + s + "\n"
 		}
 		// Page theme overrides global so exit with that.
 		if s != "" {
-			return "<style>\n" + stylesheets + overrides + "</style>" + "\n"
+			return stylesheets + overrides
 		}
 	}
 
@@ -1369,17 +1915,162 @@ func (c *config) inlineStylesheets(dir string) string {
 			s = "\n/* " + filepath.Base(filename) + "*/\n" +
 				// If the file is local, read it in.
 				// If it's at a URL, download it.
-				c.getWebOrLocalFileStr(fullPath)
+				c.stylesheetStr(fullPath)
 			stylesheets = stylesheets + s + themePageStyles + "\n"
 		}
 		if s != "" {
-			return "<style>\n" + stylesheets + overrides + "</style>" + "\n"
+			return stylesheets + overrides
 		}
 	}
-	if overrides != "" {
-		return "<style>\n" + overrides + "</style>" + "\n"
+	return overrides
+}
+
+// Name of the webroot directory holding stylesheet
+// bundles and the assets they refer to
+const assetsDir = "assets"
+
+// cssURLRe matches a url() reference in a stylesheet,
+// capturing the URL without quotes.
+var cssURLRe = regexp.MustCompile(`url\(\s*['"]?([^'")\s]*)['"]?\s*\)`)
+
+// stylesheetStr() returns the contents of the stylesheet at
+// fullPath, which may be a URL. When stylesheets are bundled,
+// local files referred to with url(), such as fonts and
+// background images, are published next to the bundle
+// under fingerprinted names, and the references changed
+// to match.
+func (c *config) stylesheetStr(fullPath string) string {
+	if strings.HasPrefix(fullPath, "http") {
+		return c.remoteStylesheetStr(fullPath, map[string]bool{fullPath: true})
+	}
+	s := c.getWebOrLocalFileStr(fullPath)
+	if !c.bundleStylesFlag {
+		return s
 	}
-	return ""
+	return cssURLRe.ReplaceAllStringFunc(s, func(match string) string {
+		ref := cssURLRe.FindStringSubmatch(match)[1]
+		if ref == "" || strings.Contains(ref, ":") ||
+			strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		// Keep any query string or fragment, as in font.svg#icon
+		name, suffix := ref, ""
+		if i := strings.IndexAny(ref, "?#"); i >= 0 {
+			name, suffix = ref[:i], ref[i:]
+		}
+		source := filepath.Join(filepath.Dir(fullPath), filepath.FromSlash(name))
+		b, err := os.ReadFile(source)
+		if err != nil {
+			warn("%s: can't find %s", c.relToRoot(fullPath), ref)
+			return match
+		}
+		ext := filepath.Ext(source)
+		filename := strings.TrimSuffix(filepath.Base(source), ext) + "." + hashBytes(b)[:8] + ext
+		c.bundleAssets[filepath.Join(c.webroot, assetsDir, filename)] = source
+		return `url("` + filename + suffix + `")`
+	})
+}
+
+// cssImportRe matches an @import rule, capturing its URL, which
+// may or may not use url(), and anything after it such as a
+// media query.
+var cssImportRe = regexp.MustCompile(`@import\s+(?:url\(\s*['"]?([^'")\s]+)['"]?\s*\)|['"]([^'"]+)['"])\s*([^;]*);`)
+
+// remoteStylesheetStr() downloads the stylesheet at rawURL
+// with downloadTextFile(), so it's cached like any other
+// download. The stylesheets its @import rules name are
+// downloaded and cached the same way, then inlined in place
+// of the rules, so nothing is left for the browser to fetch
+// from a site built with -offline. References made with url()
+// are resolved against rawURL so they still work from the page.
+// seen holds the stylesheets being inlined, to stop import loops.
+func (c *config) remoteStylesheetStr(rawURL string, seen map[string]bool) string {
+	s := c.downloadTextFile(rawURL)
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		quit(1, err, c, "Unable to read stylesheet URL %s", rawURL)
+	}
+	s = cssURLRe.ReplaceAllStringFunc(s, func(match string) string {
+		ref := cssURLRe.FindStringSubmatch(match)[1]
+		if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "data:") {
+			return match
+		}
+		abs, err := base.Parse(ref)
+		if err != nil {
+			return match
+		}
+		return `url("` + abs.String() + `")`
+	})
+	return cssImportRe.ReplaceAllStringFunc(s, func(rule string) string {
+		m := cssImportRe.FindStringSubmatch(rule)
+		ref, media := m[1]+m[2], strings.TrimSpace(m[3])
+		// Cascade layers and supports() conditions
+		// have no equivalent once the rule is inlined
+		if strings.HasPrefix(media, "layer") || strings.HasPrefix(media, "supports") {
+			return rule
+		}
+		imported, err := base.Parse(ref)
+		if err != nil || !strings.HasPrefix(imported.Scheme, "http") {
+			return rule
+		}
+		key := imported.String()
+		if seen[key] {
+			warn("%s: skipping @import of %s, which imports it in turn", rawURL, key)
+			return ""
+		}
+		seen[key] = true
+		css := c.remoteStylesheetStr(key, seen)
+		delete(seen, key)
+		if media != "" {
+			css = "@media " + media + " {\n" + css + "\n}"
+		}
+		return "\n/* " + key + " */\n" + css + "\n"
+	})
+}
+
+// bundledStylesheets() concatenates the stylesheets used by
+// the current page into one file named after the theme and
+// a hash of its contents, for example, assets/clerk.3f9a1c07.css,
+// and returns a link tag for it. Pages using the same
+// stylesheets share a bundle, so it's only published once
+// and browsers only download it once.
+func (c *config) bundledStylesheets(dir string) string {
+	css := c.themeCSS(dir)
+	if css == "" {
+		return ""
+	}
+	name := "styles"
+	if c.pageTheme.present && c.pageTheme.name != "" {
+		name = c.pageTheme.name
+	} else if c.theme.present && c.theme.name != "" {
+		name = c.theme.name
+	}
+	filename := name + "." + hashBytes([]byte(css))[:8] + ".css"
+	target := filepath.Join(c.webroot, assetsDir, filename)
+	if _, ok := c.bundles[target]; !ok {
+		c.bundles[target] = c.minifyString("text/css", filename, css)
+	}
+	return fmt.Sprintf("<link rel=\"stylesheet\" href=\"/%s/%s\">\n", assetsDir, filename)
+}
+
+// writeBundles() publishes the stylesheet bundles created
+// by bundledStylesheets() and the assets they refer to,
+// along with any libraries from vendorScript().
+func (c *config) writeBundles() {
+	if len(c.bundles) == 0 && len(c.bundleAssets) == 0 {
+		return
+	}
+	dir := filepath.Join(c.webroot, assetsDir)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		quit(1, err, c, "Unable to create directory %s", dir)
+	}
+	for target, css := range c.bundles {
+		stringToFile(c, target, css)
+	}
+	for target, source := range c.bundleAssets {
+		copyFile(c, source, target)
+	}
+	c.verbose("%d stylesheet bundles, %d assets", len(c.bundles), len(c.bundleAssets))
 }
 
 // copyPocoDirToWebroot copies the .poco directory
@@ -1399,7 +2090,11 @@ func (c *config) copyPocoDirToWebroot() {
 func (c *config) stylesheets() string {
 	// Return value
 	s := ""
-	if c.linkStylesOption {
+	if c.bundleStylesFlag {
+		// Link to one shared file per theme instead
+		// of repeating the stylesheets on every page.
+		s = c.bundledStylesheets(c.root)
+	} else if c.linkStylesOption {
 		// Normally stylesheets are inlined.
 		// This allows them to be linked to as usual.
 		c.copyPocoDirToWebroot()
@@ -1528,6 +2223,11 @@ func (c *config) loadTheme(filename string) {
 	// their corresponding local or global themes.
 	// c.pageFm = map[string]interface{}{}
 	c.pageFm = c.getFm(filename)
+	// The home page's front matter doubles as
+	// sitewide settings.
+	if filename == c.homePage {
+		c.globalFm = c.pageFm
+	}
 
 	// Get the page theme, if any.
 	// If on the home page, look for both global
@@ -1535,6 +2235,12 @@ func (c *config) loadTheme(filename string) {
 	// Load data structures for those themes.
 	c.getThemeData(filename)
 
+} // loadTheme (new version)
+
+// loadPageElements() follows loadTheme(). Once the page's
+// theme data structures are ready and its article has been
+// converted, it reads in the page layout elements.
+func (c *config) loadPageElements() {
 	// If a page theme has been named, the data structures are ready.
 	// Read in its style sheets, style tags, and page layout elements.
 	if c.pageTheme.present {
@@ -1551,8 +2257,7 @@ func (c *config) loadTheme(filename string) {
 		c.addPageElements(&c.theme)
 		return
 	}
-
-} // loadTheme (new version)
+}
 
 func (c *config) addPageElements(t *theme) {
 	c.layoutElement("article", t)
@@ -1560,6 +2265,14 @@ func (c *config) addPageElements(t *theme) {
 	c.layoutElement("nav", t)
 	c.layoutElement("aside", t)
 	c.layoutElement("footer", t)
+	// Menus mark the current page, so a burger generated
+	// from a menu has to be rebuilt for every page.
+	if t.burgerMenu != "" {
+		t.burger = t.burgerHTML(string(c.menuHTML(t.burgerMenu)))
+	}
+	for i := range t.regions {
+		c.layoutRegion(&t.regions[i], t)
+	}
 }
 
 // getThemeReadme() happens when a theme is being
@@ -1575,11 +2288,16 @@ func (t *theme) getThemeReadme(fm map[string]interface{}) {
 	t.navFilename = fmStr("nav", fm)
 	t.asideFilename = fmStr("aside", fm)
 	t.footerFilename = fmStr("footer", fm)
+	t.getRegions(fm)
+	t.getLayout(fm)
+	t.highlight = highlightSettings(fm)
 	t.styleTagNames = fmStrSlice("styles", fm)
 	t.stylesheetFilenames = fmStrSlice("stylesheets", fm)
 	// TODO: Why not do this with header, footer, etc.-just suck them up now
 	t.hamburgerIcon = fmStr("burgericon", fm)
 	t.hamburgerToHTML(fm)
+	t.burgerMenu = fmStr("burgermenu", fm)
+	t.navMenu = fmStr("navmenu", fm)
 	t.supportedFeatures = fmStrSlice("supportedfeatures", fm)
 
 }
@@ -1587,7 +2305,19 @@ func (t *theme) getThemeReadme(fm map[string]interface{}) {
 // newConfig allocates a config object.
 // sitewide configuration info.
 func newConfig() *config {
-	config := config{}
+	config := config{
+		imageVariants: map[string]imageVariant{},
+		bundles:       map[string]string{},
+		bundleAssets:  map[string]string{},
+		downloads:     map[string]string{},
+		integrity:     map[string]string{},
+		cspPolicies:   map[string]string{},
+		timeout:       defaultTimeout,
+	}
+	// Template functions have to be present even on
+	// throwaway config objects, or templates using them
+	// won't parse.
+	config.addTemplateFunctions()
 	return &config
 
 }
@@ -1610,16 +2340,31 @@ func (c *config) parseCommandLine() {
 	// linkStylesOption controls whether stylesheets are inlined (normally they are)
 	// flag.BoolVar(&c.linkStylesOption, "link-styles", false, "Link to stylesheets instead of inlining them")
 
+	// bundle-styles publishes each theme's stylesheets as one shared file
+	flag.BoolVar(&c.bundleStylesFlag, "bundle-styles", false, "Link to one shared stylesheet file per theme instead of inlining stylesheets")
+
 	// lang sets HTML lang= value, such as <html lang="fr">
 	// for all files
 	flag.StringVar(&c.lang, "lang", "en", "HTML language designation, such as en or fr")
 
+	// Command-line flag -minify shrinks published HTML, CSS, and Javascript
+	flag.BoolVar(&c.minifyFlag, "minify", false, "Remove comments and whitespace from published HTML, CSS, and Javascript")
+
+	// Command-line flag -csp generates a Content-Security-Policy
+	flag.StringVar(&c.csp, "csp", "", "Add a Content-Security-Policy allowing only Poco's own inline scripts and styles: meta, headers, or both")
+
+	// Command-line flag -lock pins the hashes of remote files
+	flag.BoolVar(&c.lockFlag, "lock", false, "Save hashes of remote files to "+pocoDir+"/"+integrityLock+" so later builds fail if they change")
+
 	// new creates a directory, sample index.md, and pocoDir
 	// This fails in the case of
 	//   poco -new
 	//flag.StringVar(&c.newProjectStr, "new", "", "Create a new site")
 	flag.BoolVar(&c.newProjectFlag, "new", false, "Create a new site")
 
+	// Command-line flag -offline builds using cached copies of remote files
+	flag.BoolVar(&c.offlineFlag, "offline", false, "Use cached copies of remote stylesheets, the stylesheets they import, and scripts instead of downloading them")
+
 	// Port server runs on
 	flag.StringVar(&c.port, "port", ":54321", "Port to use for localhost web server")
 
@@ -1643,10 +2388,17 @@ func (c *config) parseCommandLine() {
 	// Command-line flag -themes lists themes in the poco directory
 	flag.BoolVar(&c.themeList, "themes", false, "Show themes in "+pocoDir+" directory")
 
+	// Command-line flag -timeout limits how long each download can take
+	flag.DurationVar(&c.timeout, "timeout", defaultTimeout, "Time limit for downloading each remote stylesheet or script, such as 10s")
+
 	// Command-line flag -timestamp inserts a timestamp at the
 	// top of the article when true
 	flag.BoolVar(&c.timestampFlag, "timestamp", false, "Insert timestamp at top of home page article")
 
+	// Command-line flag -upgrade merges a newer embedded .poco
+	// directory into the project without clobbering customizations
+	flag.BoolVar(&c.upgradeFlag, "upgrade", false, "Add and update "+pocoDir+" files from this version of Poco")
+
 	// Verbose shows progress as site is generated.
 	flag.BoolVar(&c.verboseFlag, "verbose", false, "Display information about project as it's generated")
 
@@ -1656,6 +2408,10 @@ func (c *config) parseCommandLine() {
 	// Process command line flags such as --verbose, --title and so on.
 	flag.Parse()
 
+	if c.csp != "" && !c.cspMeta() && !c.cspHeaders() {
+		quit(1, nil, nil, "-csp must be meta, headers, or both, not %s", c.csp)
+	}
+
 	// Figure out the starting directory
 	c.root = flag.Arg(0)
 	if c.root == "" || c.root == "." {
@@ -1702,9 +2458,6 @@ func main() {
 
 	c := newConfig()
 
-	// Add snazzy Go template functions like ftime() etc.
-	c.addTemplateFunctions()
-
 	// Collect command-line flags, directory to build,
 	// learn root location, etc.
 	c.parseCommandLine()
@@ -1723,6 +2476,15 @@ func main() {
 		c.askToCopyTheme()
 	}
 
+	// -upgrade only makes sense for an existing project.
+	if c.upgradeFlag {
+		if !validProject {
+			quit(1, nil, nil, "No PocoCMS project at %s to upgrade. Quitting.", c.root)
+		}
+		c.upgradePocoDir(pocoFiles)
+		os.Exit(0)
+	}
+
 	// Quit if running in main application directory
 	if executableDir() == c.root {
 		quit(1, nil, c, "%s", "Don't run poco in its own directory. Quitting.")
@@ -1816,7 +2578,7 @@ func doTemplate(templateName string, source string, c *config) (string, error) {
 	if templateName == "" {
 		templateName = "PocoCMS"
 	}
-	tmpl, err := template.New(templateName).Parse(source)
+	tmpl, err := template.New(templateName).Funcs(c.funcs).Parse(unescapeActions(source, c.funcs))
 	if err != nil {
 		return "", err
 	}
@@ -1825,7 +2587,24 @@ func doTemplate(templateName string, source string, c *config) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return buf.String(), err
+	return strings.ReplaceAll(buf.String(), literalBraces, "{{"), err
+}
+
+// funcActionRe matches a Go template action calling a
+// function, such as {{ menu "main" }}, capturing the function name
+var funcActionRe = regexp.MustCompile(`\{\{-?\s*(\w+)\s.*?\}\}`)
+
+// unescapeActions() restores the quotes in calls to the template
+// functions in funcs that went through Markdown conversion.
+// Goldmark turns {{ menu "main" }} into {{ menu &quot;main&quot; }},
+// which won't parse as a template. Other text is left alone.
+func unescapeActions(source string, funcs map[string]interface{}) string {
+	return funcActionRe.ReplaceAllStringFunc(source, func(action string) string {
+		if _, ok := funcs[funcActionRe.FindStringSubmatch(action)[1]]; !ok {
+			return action
+		}
+		return strings.ReplaceAll(action, "&quot;", `"`)
+	})
 }
 
 // buildFileToFile converts a file from Markdown to HTML, generates an output file,
@@ -1856,16 +2635,30 @@ func buildFileToTemplatedString(c *config, filename string) (string, string) {
 	// This will be the proposed name for the completed HTML file.
 	dest := ""
 	var err error
-	// Convert the Markdown file to an HTML string
+	// Convert the Markdown file to an HTML string.
+	// It happens before the page layout elements are
+	// generated so their templates see this page's
+	// front matter and table of contents.
 	if c.articleRawHTML, err = mdYAMLFileToHTMLString(c, filename); err != nil {
 		quit(1, err, c, "Error converting Markdown file %v to HTML", filename)
 		return "", ""
 	} else {
+		c.loadPageElements()
+		c.articleRawHTML = c.insertTOC(c.articleRawHTML)
+		c.articleRawHTML = c.renderDiagrams(c.articleRawHTML)
+		c.articleRawHTML = c.processImages(c.articleRawHTML)
 		// Strip original file's Markdown extension and make
 		// the destination files' extension HTML
 		dest = replaceExtension(filename, "html")
 		// Take the raw converted HTML and use it to generate a complete HTML document in a string
 		finishedDocument := c.assemble(c.currentFilename)
+		// The not-found page can be served from any path
+		if c.currentIsNotFoundPage() {
+			finishedDocument = rootRelativeLinks(finishedDocument, c.currentURL())
+		}
+		c.addToSearchIndex()
+		finishedDocument = c.minifyString("text/html", c.currentFilename, finishedDocument)
+		finishedDocument = c.addCSP(finishedDocument)
 		// Return the finishled document and its filename
 		return finishedDocument, dest
 	}
@@ -1979,7 +2772,12 @@ func (c *config) buildSite() {
 		// If the filename ends with a path separator,
 		// create that directory in the webroot.
 		if ending == sep {
-			dir := filepath.Join(c.webroot, filename)
+			// In multilingual sites the content directory's
+			// files are published elsewhere.
+			if c.multilingual() && filepath.ToSlash(filename) == contentDir+"/" {
+				continue
+			}
+			dir := filepath.Join(c.webroot, filepath.FromSlash(c.langPath(filepath.ToSlash(filename))))
 			err := os.MkdirAll(dir, os.ModePerm)
 			if err != nil && !os.IsExist(err) {
 				quit(1, err, c, "Unable to create directory %s", dir)
@@ -1992,8 +2790,12 @@ func (c *config) buildSite() {
 
 		// Full pathname of location of copied file in webroot
 		// If it's an asset (non-Markdown file), it will be
-		// copied as is.
-		target := filepath.Join(c.webroot, filename)
+		// copied as is. Translations are published under
+		// a directory named for their language.
+		target := filepath.Join(c.webroot, filepath.FromSlash(c.langPath(filepath.ToSlash(filename))))
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			quit(1, err, c, "Unable to create directory %s", filepath.Dir(target))
+		}
 
 		// Obtain file extension.
 		ext := path.Ext(c.currentFilename)
@@ -2005,26 +2807,40 @@ func (c *config) buildSite() {
 			// then rename with HTML extensions.
 			//jjHTML, _ := buildFileToTemplatedString(c, filename)
 			HTML, _ := buildFileToTemplatedString(c, c.currentFilename)
-			target := filepath.Join(c.webroot, filename)
 			target = replaceExtension(target, "html")
 			target = stringToFile(c, target, HTML)
 			c.mdCopied++
 
 		} else {
-			// It's an asset. Just pass through.
-			//copyFile(c, source, target)
-			copyFile(c, source, target)
+			// It's an asset. Just pass through,
+			// unless it's a stylesheet or script to minify.
+			if !c.minifyFlag || !c.minifyFile(source, target) {
+				copyFile(c, source, target)
+			}
 			assetsCopied++
 		}
 
 		c.copied += 1
 	}
 	// ALL files now copied
+	c.updatePageLastmods()
+	c.buildSearchPage()
+	c.writeSearchIndex()
+	c.writeImageVariants()
+	c.writeBundles()
+	c.writeIntegrityLock()
+	c.writeCSPHeaders()
+	c.writeRedirects()
+	c.writeSitemaps()
+	c.writeFeeds()
 	// This is where the files were published
 	ensureIndexHTML(c.webroot, c)
 	// Display all files, Markdown or not, that were processed
 	c.verbose("%s converted, %s copied. %d total", fileCount("Markdown", c.mdCopied), fileCount("asset", assetsCopied), c.copied)
 	//c.copied, mdCopied, assetsCopied)
+	if report := c.minifyReport(); report != "" {
+		print("%s", report)
+	}
 } // buildSite()
 
 // fileCount returns a string containing
@@ -2272,27 +3088,125 @@ func stringToFile(c *config, filename, contents string) string {
 	return filename
 }
 
-// downloadFile() tries to read in the named URL as text and return
-// its contents as a string.
+// Name of directory under the cache holding downloaded files
+const downloadCacheDir = "downloads"
+
+// How long a remote file can take to download
+// unless -timeout says otherwise
+const defaultTimeout = 30 * time.Second
+
+// downloadMeta is saved next to a downloaded file in
+// the cache to revalidate it on later builds.
+type downloadMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// downloadTextFile() reads in the named URL as text and returns
+// its contents as a string. Quits if it can't.
+// See fetch().
 func (c *config) downloadTextFile(url string) string {
-	req, err := http.NewRequest("GET", url, nil)
+	s, err := c.fetch(url)
 	if err != nil {
-		quit(1, err, c, "Unable setting up to GET file %s", url)
+		quit(1, err, c, "Unable to download file %s", url)
 	}
-	req.Header.Set("Accept", "application/text")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		quit(1, err, c, "Unable to download file %s", url)
+	return s
+}
+
+// fetch() returns the contents of the named URL. Each URL
+// is downloaded at most once per build, and only from hosts
+// allowed by remotehosts: on the home page. Its contents
+// are checked against any hash pinned for it, so a remote
+// stylesheet that's inlined can't change without the
+// build failing. See fetchCached(), checkIntegrity().
+func (c *config) fetch(url string) (string, error) {
+	if s, ok := c.downloads[url]; ok {
+		return s, nil
+	}
+	if err := c.allowedHost(url); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
-	b, err := io.ReadAll(resp.Body)
+	s, err := c.fetchCached(url)
 	if err != nil {
-		quit(1, err, c, "Unable to read reponse body for %s", url)
+		return "", err
+	}
+	if err := c.checkIntegrity(url, []byte(s)); err != nil {
+		return "", err
+	}
+	c.downloads[url] = s
+	return s, nil
+}
+
+// fetchCached() downloads the named URL. Downloads are kept in
+// .poco/cache/downloads and revalidated with the server's
+// ETag or Last-Modified header, so unchanged files aren't
+// downloaded again. If the server can't be reached, the cached
+// copy is used with a warning. With -offline, only cached
+// copies are used.
+func (c *config) fetchCached(url string) (string, error) {
+	key := hashBytes([]byte(url))[:32]
+	dir := filepath.Join(c.root, pocoDir, cacheDir, downloadCacheDir)
+	cached := filepath.Join(dir, key)
+	var meta downloadMeta
+	body, cacheErr := os.ReadFile(cached)
+	if cacheErr == nil {
+		if b, err := os.ReadFile(cached + ".json"); err == nil {
+			json.Unmarshal(b, &meta)
+		}
+	}
+	if c.offlineFlag {
+		if cacheErr != nil {
+			return "", fmt.Errorf("no cached copy to use with -offline")
+		}
+		return string(body), nil
 	}
 
-	return string(b)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if cacheErr == nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	client := &http.Client{Timeout: c.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		if cacheErr != nil {
+			return "", err
+		}
+		warn("Unable to download %s. Using cached copy. %v", url, err)
+		return string(body), nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cacheErr == nil {
+		return string(body), nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	if body, err = io.ReadAll(resp.Body); err != nil {
+		return "", err
+	}
 
+	// Save the file and its validators for next time.
+	meta = downloadMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		quit(1, err, c, "Unable to create download cache directory %s", dir)
+	}
+	stringToFile(c, cached, string(body))
+	b, _ := json.MarshalIndent(meta, "", "  ")
+	stringToFile(c, cached+".json", string(b))
+	return string(body), nil
 }
 
 // getWebOrLocalFileStr reads contentws of filename
@@ -2304,8 +3218,6 @@ func (c *config) getWebOrLocalFileStr(filename string) string {
 
 	// Handle case of URLs as opposed to local file
 	if strings.HasPrefix(filename, "http") {
-		// TODO: Check for redirect?
-		// https://golangdocs.com/golang-download-files
 		s = c.downloadTextFile(filename)
 		return s
 		//
@@ -2329,7 +3241,8 @@ func (c *config) getWebOrLocalFileStr(filename string) string {
 // then copies the .poco directory.
 // It does not check for an existing site.
 // Pre:
-//   parseCommandLine()
+//
+//	parseCommandLine()
 func (c *config) newSite() {
 	dir := filepath.Join(c.root, pocoDir)
 	err := os.MkdirAll(dir, os.ModePerm)
@@ -2337,96 +3250,303 @@ func (c *config) newSite() {
 		quit(1, err, c, "Unable to create new project directory %s", dir)
 	}
 	writeDefaultHomePage(c, c.root)
-  c.copyEmbeddedPocoDir(pocoFiles, c.root); 
+	c.copyEmbeddedPocoDir(pocoFiles, c.root)
+	// Remember what was installed so -upgrade can
+	// tell which files the user has customized.
+	c.writeManifest(c.embeddedHashes(pocoFiles))
 }
 
-// copyEmbeddedPocoDir copies the .poco directory 
+// copyEmbeddedPocoDir copies the .poco directory
 // that's embedded in the Poco execuable to
 // the given directory, which is normally
 // a new project directory.
 func (c *config) copyEmbeddedPocoDir(files embed.FS, dir string) {
-  fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
-    if err != nil {
-      quit(1, err, nil, "Walkdir error at " + dir)
-      return err
-    }
-    if d.IsDir() {
+	fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			quit(1, err, nil, "Walkdir error at "+dir)
+			return err
+		}
+		if d.IsDir() {
 			dest := filepath.Join(c.root, path)
 			err := os.MkdirAll(dest, os.ModePerm)
 			if err != nil && !os.IsExist(err) {
 				quit(1, err, c, "Unable to copy embedded directory %s", c.webroot)
 			}
-    } else {
-      dest := filepath.Join(dir, path)
-      c.embedCp(files, path, dest)
-    }
-    return nil
-  })
+		} else {
+			dest := filepath.Join(dir, path)
+			c.embedCp(files, path, dest)
+		}
+		return nil
+	})
 }
 
-
 // ls() is a diagnostic routine to display the contents
 // of the embedded poco directory
-func ls (files embed.FS, dir string) {
-  fs.WalkDir(files, dir, func(path string, d fs.DirEntry, err error) error {
-    if err != nil {
-      quit(1, err, nil, "Walkdir error at " + dir)
-      return err
-    }
-    if d.IsDir() {
-      fmt.Printf("mkdir %s\n", path)
-    } else {
-      filename := filepath.Join(path, d.Name())
-      fmt.Println(filename)
-      show(files, path)
-    }
-    return nil
-  })
+func ls(files embed.FS, dir string) {
+	fs.WalkDir(files, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			quit(1, err, nil, "Walkdir error at "+dir)
+			return err
+		}
+		if d.IsDir() {
+			fmt.Printf("mkdir %s\n", path)
+		} else {
+			filename := filepath.Join(path, d.Name())
+			fmt.Println(filename)
+			show(files, path)
+		}
+		return nil
+	})
 }
 
 func show(files embed.FS, filename string) {
-  f, err := files.Open(filename); 
-  if err != nil {
-    fmt.Printf("Error opening %s: %v\n", filename, err.Error())
-    os.Exit(1)
-  }
-  bytes, err := ioutil.ReadAll(f); 
-  if err != nil {
-    fmt.Printf("Error reading %s: %v\n", filename, err.Error())
-  } else {
-    fmt.Println(string(bytes))
-    os.Exit(1)
-  }
-  err = f.Close()
-  if err != nil {
-    quit(1, err, nil, "Error closing embedded file", filename)
-  }
+	f, err := files.Open(filename)
+	if err != nil {
+		fmt.Printf("Error opening %s: %v\n", filename, err.Error())
+		os.Exit(1)
+	}
+	bytes, err := ioutil.ReadAll(f)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", filename, err.Error())
+	} else {
+		fmt.Println(string(bytes))
+		os.Exit(1)
+	}
+	err = f.Close()
+	if err != nil {
+		quit(1, err, nil, "Error closing embedded file %s", filename)
+	}
+
+}
+
+func (c *config) embedCp(files embed.FS, filename string, dest string) {
+	//wait("embedCp() copy %s to %s", filename, dest)
+	f, err := files.Open(filename)
+	if err != nil {
+		quit(1, err, c, "Error opening embedded file %s", filename)
+	}
+	bytes, err := ioutil.ReadAll(f)
+	if err != nil {
+		quit(1, err, c, "Error reading embedded file %s", filename)
+	}
+	err = ioutil.WriteFile(dest, bytes, 0644)
+	if err != nil {
+		quit(1, err, c, "Error copying embedded file %s", dest)
+	}
+	err = f.Close()
+	if err != nil {
+		quit(1, err, c, "Error closing embedded file %s", filename)
+	}
+}
 
+// UPGRADE UTILITIES
+
+// Name of the file inside pocoDir recording a hash of
+// every file Poco copied into the project. It's how
+// -upgrade tells files the user customized apart from
+// files that are safe to replace.
+const pocoManifest = "manifest.json"
+
+// hashBytes() returns the SHA-256 hash of b as a hex string.
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
 }
 
+// embeddedHashes() returns the hash of every file in the
+// embedded .poco directory, keyed by its slash-separated
+// path relative to the project root, for example
+// ".poco/css/reset.css".
+func (c *config) embeddedHashes(files embed.FS) map[string]string {
+	hashes := map[string]string{}
+	fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			quit(1, err, c, "Walkdir error at %s", path)
+			return err
+		}
+		if !d.IsDir() {
+			b, err := fs.ReadFile(files, path)
+			if err != nil {
+				quit(1, err, c, "Error reading embedded file %s", path)
+			}
+			hashes[path] = hashBytes(b)
+		}
+		return nil
+	})
+	return hashes
+}
 
+// readManifest() returns the hashes recorded the last time
+// Poco wrote the project's .poco directory. Projects created
+// before manifests existed return an empty map, which means
+// every file that differs is treated as customized.
+func (c *config) readManifest() map[string]string {
+	manifest := map[string]string{}
+	filename := filepath.Join(c.root, pocoDir, pocoManifest)
+	if !fileExists(filename) {
+		return manifest
+	}
+	if err := json.Unmarshal(fileToBuf(filename), &manifest); err != nil {
+		quit(1, err, c, "Unable to read manifest %s", filename)
+	}
+	return manifest
+}
 
+// writeManifest() records hashes in the project's .poco directory
+// so a later -upgrade can detect user-modified files.
+func (c *config) writeManifest(hashes map[string]string) {
+	b, err := json.MarshalIndent(hashes, "", "  ")
+	if err != nil {
+		quit(1, err, c, "Unable to create manifest")
+	}
+	filename := filepath.Join(c.root, pocoDir, pocoManifest)
+	stringToFile(c, filename, string(b)+"\n")
+}
 
-func (c *config) embedCp(files embed.FS, filename string, dest string) {
-  //wait("embedCp() copy %s to %s", filename, dest)
-  f, err := files.Open(filename)
-  if err != nil {
-    quit(1, err, c, "Error opening embedded file", filename)
-  }
-  bytes, err := ioutil.ReadAll(f) 
-  if err != nil {
-    quit(1, err, c, "Error reading embedded file", filename)
-  }
-  err = ioutil.WriteFile(dest, bytes, 0644)
-  if err != nil {
-    quit(1, err, c, "Error copying embedded file", dest)
-  }
-  err = f.Close()
-  if err != nil {
-    quit(1, err, c, "Error closing embedded file", filename)
-  }
+// upgradePocoDir() merges the .poco directory embedded in
+// this copy of Poco into an existing project:
+//
+//   - Files missing from the project are added.
+//   - Files the user never touched are replaced by the new version.
+//   - Files the user customized are shown as a diff. If the user
+//     declines to replace one, the new version is written next to
+//     it with a .new extension so nothing gets clobbered.
+//
+// Pre: c.root is a valid project
+func (c *config) upgradePocoDir(files embed.FS) {
+	manifest := c.readManifest()
+	hashes := c.embeddedHashes(files)
+	added, updated, kept := 0, 0, 0
+
+	// Visit in a predictable order so the prompts do too.
+	paths := make([]string, 0, len(hashes))
+	for path := range hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Without a manifest there's no telling which files the
+	// user changed, so offer to replace them all at once
+	// rather than asking about every one.
+	replaceAll := false
+	if len(manifest) == 0 {
+		changed := 0
+		for _, path := range paths {
+			dest := filepath.Join(c.root, filepath.FromSlash(path))
+			if fileExists(dest) && hashBytes(fileToBuf(dest)) != hashes[path] {
+				changed++
+			}
+		}
+		if changed > 0 {
+			print("%s has no record of the files Poco installed, so it's not known which of the %d changed files were customized.", filepath.Join(c.root, pocoDir), changed)
+			replaceAll = promptYes("Replace all %d with the new versions? (Y/N) ", changed)
+		}
+	}
+
+	for _, path := range paths {
+		b, err := fs.ReadFile(files, path)
+		if err != nil {
+			quit(1, err, c, "Error reading embedded file %s", path)
+		}
+		dest := filepath.Join(c.root, filepath.FromSlash(path))
+		c.currentFilename = dest
+
+		// New file in this release of Poco.
+		if !fileExists(dest) {
+			if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+				quit(1, err, c, "Unable to create directory for %s", dest)
+			}
+			c.verbose("Adding %s", dest)
+			stringToFile(c, dest, string(b))
+			added++
+			continue
+		}
+
+		current := fileToBuf(dest)
+		// Nothing to do if it's already up to date.
+		if bytes.Equal(current, b) {
+			continue
+		}
+
+		// File differs but still matches what Poco shipped last
+		// time, so the user didn't change it. Safe to replace.
+		if original, ok := manifest[path]; replaceAll || (ok && original == hashBytes(current)) {
+			c.verbose("Updating %s", dest)
+			stringToFile(c, dest, string(b))
+			updated++
+			continue
+		}
+
+		// The user customized this file. Only text files get a diff.
+		if isText(current) && isText(b) {
+			print("\n%s has been changed since it was installed:\n%s", dest,
+				lineDiff(string(current), string(b)))
+		} else {
+			print("\n%s has been changed since it was installed", dest)
+		}
+		if promptYes("Replace %s with the new version? (Y/N) ", dest) {
+			stringToFile(c, dest, string(b))
+			updated++
+		} else {
+			stringToFile(c, dest+".new", string(b))
+			print("New version saved as %s", dest+".new")
+			kept++
+		}
+	}
+
+	c.writeManifest(hashes)
+	print("%d added, %d updated, %d customized files kept", added, updated, kept)
 }
 
+// isText() reports whether b looks like text rather than,
+// say, an image: valid UTF-8 with no NUL bytes.
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+// lineDiff() compares before and after line by line. It returns
+// the lines that changed, prefixed with "-" for lines only in before
+// and "+" for lines only in after. Unchanged lines are omitted.
+func lineDiff(before, after string) string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// lcs[i][j] holds the length of the longest common
+	// subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table to produce the changes.
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
 
 // Generates a simple home page
 // and writes it to index.md in dir. Uses the file
@@ -2486,7 +3606,8 @@ func (c *config) linktags() string {
 	for _, tag := range linkTags {
 		tags += "\t" + tag + "\n"
 	}
-	return tags
+	// Remote stylesheets and scripts get integrity attributes
+	return c.addIntegrity(tags)
 }
 
 // metatag() generates a metatag such as
@@ -2519,6 +3640,209 @@ func (c *config) titleTag() string {
 	}
 }
 
+// SOCIAL AND SEARCH ENGINE METADATA
+//
+// Open Graph, Twitter Card, JSON-LD, and canonical
+// tags come from the page's front matter, with the
+// home page's front matter supplying site-wide
+// defaults and settings:
+//
+//	---
+//	baseurl: "https://example.com"
+//	sitename: "Example"
+//	description: "Used by pages without a description"
+//	image: "/img/card.png"
+//	author: "Tom Campbell"
+//	twitter: "@pococms"
+//	---
+//
+// A page can add:
+//
+//	---
+//	title: "Release notes"
+//	description: "What's new"
+//	image: "release.png"
+//	date: 2024-05-01
+//	modified: 2024-05-03
+//	schematype: BlogPosting
+//	---
+
+// metaProperty() generates an Open Graph meta tag such as
+// <meta property="og:title" content="Release notes">
+// If content is empty it returns the empty string.
+func metaProperty(property string, content string) string {
+	if content == "" {
+		return ""
+	}
+	return "\t<meta property=\"" + property + "\"" +
+		" content=\"" + htmlstd.EscapeString(content) + "\">\n"
+}
+
+// fmDate() returns a date from the front matter in ISO 8601
+// format, e.g. 2024-05-01, or "" if there isn't one.
+func fmDate(key string, fm map[string]interface{}) string {
+	switch v := fm[strings.ToLower(key)].(type) {
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// siteSetting() returns the page's value for key, or
+// the site-wide value from the home page.
+func (c *config) siteSetting(key string) string {
+	if s := fmStr(key, c.pageFm); s != "" {
+		return s
+	}
+	return fmStr(key, c.globalFm)
+}
+
+// siteName() returns sitename: from the home
+// page, or else the home page's title.
+func (c *config) siteName() string {
+	if s := fmStr("sitename", c.globalFm); s != "" {
+		return s
+	}
+	return fmStr("title", c.globalFm)
+}
+
+// absURL() returns the URL for link, which is relative to
+// the current page or to the site root if it starts with /,
+// as an absolute URL using baseurl: from the home page.
+// Without baseurl: it returns a root-relative URL.
+func (c *config) absURL(link string) string {
+	if link == "" || strings.Contains(link, "://") {
+		return link
+	}
+	if !strings.HasPrefix(link, "/") {
+		link = path.Join(path.Dir(c.currentURL()), link)
+	}
+	return strings.TrimSuffix(fmStr("baseurl", c.globalFm), "/") + link
+}
+
+// canonicalTag() returns a canonical link tag for
+// the current page if the site has a baseurl:.
+func (c *config) canonicalTag() string {
+	if fmStr("baseurl", c.globalFm) == "" {
+		return ""
+	}
+	return "\t<link rel=\"canonical\" href=\"" + htmlstd.EscapeString(c.absURL(c.currentURL())) + "\">\n"
+}
+
+// socialTags() returns Open Graph and Twitter Card meta tags,
+// which control how the page looks when it's shared.
+func (c *config) socialTags() string {
+	title := fmStr("title", c.pageFm)
+	if title == "" {
+		title = c.siteName()
+	}
+	description := c.siteSetting("description")
+	image := c.absURL(c.siteSetting("image"))
+	ogType := "website"
+	if c.currentFilename != c.homePage {
+		ogType = "article"
+	}
+	tags := metaProperty("og:title", title) +
+		metaProperty("og:description", description) +
+		metaProperty("og:type", ogType) +
+		metaProperty("og:site_name", c.siteName()) +
+		metaProperty("og:image", image)
+	if fmStr("baseurl", c.globalFm) != "" {
+		tags += metaProperty("og:url", c.absURL(c.currentURL()))
+	}
+	if ogType == "article" {
+		tags += metaProperty("article:published_time", fmDate("date", c.pageFm)) +
+			metaProperty("article:modified_time", fmDate("modified", c.pageFm)) +
+			metaProperty("article:author", c.siteSetting("author"))
+	}
+	card := "summary"
+	if image != "" {
+		card = "summary_large_image"
+	}
+	return tags + metatag("twitter:card", card) +
+		metatag("twitter:site", htmlstd.EscapeString(fmStr("twitter", c.globalFm))) +
+		metatag("twitter:title", htmlstd.EscapeString(title)) +
+		metatag("twitter:description", htmlstd.EscapeString(description)) +
+		metatag("twitter:image", htmlstd.EscapeString(image))
+}
+
+// jsonLD() returns JSON-LD structured data for search
+// engines: WebSite for the home page, and Article (or
+// whatever schematype: says, such as BlogPosting) plus a
+// BreadcrumbList for other pages.
+func (c *config) jsonLD() string {
+	const context = "https://schema.org"
+	objects := []map[string]interface{}{}
+	add := func(m map[string]interface{}, key string, value interface{}) {
+		if s, ok := value.(string); !ok || s != "" {
+			m[key] = value
+		}
+	}
+	if c.currentFilename == c.homePage {
+		site := map[string]interface{}{"@context": context, "@type": "WebSite"}
+		add(site, "name", c.siteName())
+		add(site, "description", fmStr("description", c.globalFm))
+		if fmStr("baseurl", c.globalFm) != "" {
+			add(site, "url", c.absURL("/"))
+		}
+		objects = append(objects, site)
+	} else {
+		schemaType := fmStr("schematype", c.pageFm)
+		if schemaType == "" {
+			schemaType = "Article"
+		}
+		article := map[string]interface{}{"@context": context, "@type": schemaType}
+		add(article, "headline", fmStr("title", c.pageFm))
+		add(article, "description", c.siteSetting("description"))
+		add(article, "image", c.absURL(c.siteSetting("image")))
+		add(article, "datePublished", fmDate("date", c.pageFm))
+		add(article, "dateModified", fmDate("modified", c.pageFm))
+		if author := c.siteSetting("author"); author != "" {
+			add(article, "author", map[string]interface{}{"@type": "Person", "name": author})
+		}
+		if fmStr("baseurl", c.globalFm) != "" {
+			add(article, "url", c.absURL(c.currentURL()))
+		}
+		objects = append(objects, article)
+		if crumbs := c.breadcrumbList(); len(crumbs) > 1 {
+			objects = append(objects, map[string]interface{}{
+				"@context":        context,
+				"@type":           "BreadcrumbList",
+				"itemListElement": crumbs,
+			})
+		}
+	}
+	s := ""
+	for _, o := range objects {
+		// json.Marshal escapes < and >, so the script can't be closed early
+		b, err := json.Marshal(o)
+		if err != nil {
+			quit(1, err, c, "Unable to create JSON-LD")
+		}
+		s += "\t<script type=\"application/ld+json\">" + string(b) + "</script>\n"
+	}
+	return s
+}
+
+// breadcrumbList() returns the breadcrumbs
+// as BreadcrumbList items.
+func (c *config) breadcrumbList() []map[string]interface{} {
+	crumbs := []map[string]interface{}{}
+	for i, crumb := range c.breadcrumbItems() {
+		item := map[string]interface{}{"@type": "ListItem", "position": i + 1, "name": crumb.Title}
+		if fmStr("baseurl", c.globalFm) != "" {
+			item["item"] = c.absURL(crumb.URL)
+		}
+		crumbs = append(crumbs, item)
+	}
+	return crumbs
+}
+
 // PRINTY utilities
 
 // quit displays a message fmt.Printf style and exits to the OS.
@@ -2629,269 +3953,4509 @@ func dumpFm(c *config) string {
 	return s
 }
 
-// PARSING UTILITIES
+// CALLOUT MARKDOWN EXTENSION
 
-// convertMdYAMLFileToHTMLFragmentStr converts the Markdown code fragment,
-// which may have front matter, to HTML.
-// It doesn't execute templates.
-// It doesn't assemble the file--that its, no header, footer, etc.
-// So "hello, world" should come back as "<p>hello, world</p>"
-// Returns parsed file as HTML.
-func convertMdYAMLFileToHTMLFragmentStr(filename string, c *config) string {
-	source := c.fileToString(filename)
-	mdParser := newGoldmark()
-	mdParserCtx := parser.NewContext()
-	// Build a syntax tree (intermediate representation)
-	// for the input Markdown text.
-	_ = mdParser.Parser().Parse(text.NewReader([]byte(source)))
-	var buf bytes.Buffer
-	// Convert syntax tree to HTML and deposit in buf.Bytes().
-	if err := mdParser.Convert([]byte(source), &buf, parser.WithContext(mdParserCtx)); err != nil {
-		quit(1, err, c, "Unable to convert Markdown to HTML")
-	}
-	return string(buf.Bytes())
+// calloutKinds are the GitHub alert types recognized in
+// blockquotes, for example:
+//
+// > [!WARNING]
+// > Back up your files first.
+var calloutKinds = []string{"note", "tip", "important", "warning", "caution"}
+
+// calloutAlertRe matches the first line of a GitHub-style alert.
+var calloutAlertRe = regexp.MustCompile(`^\s*\[!(\w+)\]\s*$`)
+
+// calloutFenceRe matches the opening line of a container block
+// such as :::tip or ::: warning Read this first
+var calloutFenceRe = regexp.MustCompile(`^(:{3,})\s*([A-Za-z]\w*)[ \t]*(.*?)\s*$`)
+
+// kindCallout identifies callout nodes in the Goldmark syntax tree.
+var kindCallout = ast.NewNodeKind("Callout")
+
+// callout is a Goldmark block node holding a note, tip,
+// warning, etc. Its children are ordinary Markdown blocks.
+type callout struct {
+	ast.BaseBlock
+	// Lowercase type of callout, used as a class name
+	kind string
+	// Optional title. Defaults to the kind, capitalized.
+	title string
+	// Number of colons in the opening fence of a ::: block
+	fence int
 }
 
-// mdYAMLFileToHTMLString converts a Markdown document
-// with YAML front matter to HTML.
-// The HTML file has not yet had templates executed,
-// Destructive: replaces c.fm
-// Returns a byte slice containing the HTML source.
-func mdYAMLFileToHTMLString(c *config, filename string) (string, error) {
-	source := fileToBuf(filename)
-	var err error
-	var HTML []byte
-	if HTML, c.fm, err = mdYAMLToHTML(source); err != nil {
-		return "", err
-	} else {
-		return string(HTML), nil
+// Kind implements ast.Node.Kind
+func (n *callout) Kind() ast.NodeKind {
+	return kindCallout
+}
+
+// Dump implements ast.Node.Dump
+func (n *callout) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Kind": n.kind, "Title": n.title}, nil)
+}
+
+// calloutParser is a Goldmark block parser for container
+// blocks like this:
+//
+// :::tip Optional title
+// Markdown goes *here*.
+// :::
+//
+// To nest one container in another, give the outer one
+// more colons than the inner one.
+type calloutParser struct{}
+
+// Trigger implements parser.BlockParser.Trigger
+func (b *calloutParser) Trigger() []byte {
+	return []byte{':'}
+}
+
+// Open implements parser.BlockParser.Open
+func (b *calloutParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 {
+		return nil, parser.NoChildren
+	}
+	m := calloutFenceRe.FindSubmatch(line[pos:])
+	if m == nil {
+		return nil, parser.NoChildren
+	}
+	node := &callout{
+		kind:  strings.ToLower(string(m[2])),
+		title: string(m[3]),
+		fence: len(m[1]),
+	}
+	// Consume the rest of the opening line.
+	reader.Advance(segment.Len() - trailingNewline(line))
+	return node, parser.HasChildren
+}
+
+// Continue implements parser.BlockParser.Continue
+func (b *calloutParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	line, segment := reader.PeekLine()
+	w, pos := util.IndentWidth(line, reader.LineOffset())
+	if w < 4 && pos < len(line) {
+		i := pos
+		for ; i < len(line) && line[i] == ':'; i++ {
+		}
+		if i-pos >= node.(*callout).fence && util.IsBlank(line[i:]) {
+			reader.Advance(segment.Len() - trailingNewline(line))
+			return parser.Close
+		}
 	}
+	return parser.Continue | parser.HasChildren
 }
 
-// newGoldmark() allocates a Goldmark parser with a
-// raft of other options.
-func newGoldmark() goldmark.Markdown {
-	exts := []goldmark.Extender{
-		meta.New(
-			meta.WithStoresInDocument(),
-		),
-		// Support GitHub tables & other extensions
-		extension.Table,
-		extension.GFM,
-		extension.DefinitionList,
-		extension.Footnote,
-		extension.Linkify,
-		// YouTube embedding
-		ytembed.New(),
-		highlighting.NewHighlighting(
-			highlighting.WithStyle("autumn"),
-			highlighting.WithFormatOptions()),
+// trailingNewline() returns 1 if line ends with a newline,
+// which the last line of a document may not.
+func trailingNewline(line []byte) int {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		return 1
 	}
+	return 0
+}
 
-	parserOpts := []parser.Option{
-		parser.WithAttribute(),
-		parser.WithAutoHeadingID()}
+// Close implements parser.BlockParser.Close
+func (b *calloutParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
 
-	renderOpts := []renderer.Option{
-		html.WithUnsafe(),
-		// html.WithHardWraps(),
-		html.WithXHTML(),
-	}
-	return goldmark.New(
-		goldmark.WithExtensions(exts...),
-		goldmark.WithParserOptions(parserOpts...),
-		goldmark.WithRendererOptions(renderOpts...),
-	)
+// CanInterruptParagraph implements parser.BlockParser.CanInterruptParagraph
+func (b *calloutParser) CanInterruptParagraph() bool {
+	return true
 }
 
-// mdYAMLStringToTemplatedHTMLString() takes raw HTML, converts to Markdown,
-// and executes templates. Returns a string of the result.
-// It doesn't assemble the file--that its, no header, footer, etc.
-// So "hello, world" should come back as "<p>hello, world</p>"
-// This should too:
-// ---
-// description: "world"
-// ---
-// hello, {{ .description }}.
-//
+// CanAcceptIndentedLine implements parser.BlockParser.CanAcceptIndentedLine
+func (b *calloutParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// calloutTransformer turns blockquotes starting with
+// [!NOTE], [!TIP], [!IMPORTANT], [!WARNING], or [!CAUTION]
+// into callouts, the way GitHub renders them.
+type calloutTransformer struct{}
+
+// Transform implements parser.ASTTransformer.Transform
+func (t *calloutTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	quotes := []*ast.Blockquote{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if bq, ok := n.(*ast.Blockquote); ok && entering {
+			quotes = append(quotes, bq)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, bq := range quotes {
+		para, ok := bq.FirstChild().(*ast.Paragraph)
+		if !ok || para.Lines().Len() == 0 {
+			continue
+		}
+		first := para.Lines().At(0)
+		m := calloutAlertRe.FindSubmatch(first.Value(source))
+		if m == nil || !slices.Contains(calloutKinds, strings.ToLower(string(m[1]))) {
+			continue
+		}
+		// Remove the [!NOTE] line from the paragraph.
+		for child := para.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			txt, ok := child.(*ast.Text)
+			if !ok || txt.Segment.Start >= first.Stop {
+				break
+			}
+			para.RemoveChild(para, child)
+			child = next
+		}
+		if para.ChildCount() == 0 {
+			bq.RemoveChild(bq, para)
+		}
+		node := &callout{kind: strings.ToLower(string(m[1]))}
+		for child := bq.FirstChild(); child != nil; {
+			next := child.NextSibling()
+			node.AppendChild(node, child)
+			child = next
+		}
+		bq.Parent().ReplaceChild(bq.Parent(), bq, node)
+	}
+}
+
+// calloutRenderer renders callouts as HTML.
+type calloutRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer.RegisterFuncs
+func (r *calloutRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindCallout, r.renderCallout)
+}
+
+// renderCallout() generates something like this, which
+// the bundled stylesheets style:
+//
+//	<div class="callout-poco callout-warning" role="note">
+//	<p class="callout-title-poco">Warning</p>
+//	<p>Back up your files first.</p>
+//	</div>
+func (r *calloutRenderer) renderCallout(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	node := n.(*callout)
+	if !entering {
+		_, _ = w.WriteString("</div>\n")
+		return ast.WalkContinue, nil
+	}
+	title := node.title
+	if title == "" {
+		title = strings.ToUpper(node.kind[:1]) + node.kind[1:]
+	}
+	_, _ = w.WriteString("<div class=\"callout-poco callout-" + node.kind + "\" role=\"note\">\n")
+	_, _ = w.WriteString("<p class=\"callout-title-poco\">")
+	_, _ = w.Write(util.EscapeHTML([]byte(title)))
+	_, _ = w.WriteString("</p>\n")
+	return ast.WalkContinue, nil
+}
+
+// calloutExtension adds GitHub-style alerts and :::
+// container blocks to Goldmark.
+type calloutExtension struct{}
+
+// Extend implements goldmark.Extender.Extend
+func (e *calloutExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		// Must come before the definition list parser,
+		// which also triggers on a colon.
+		parser.WithBlockParsers(util.Prioritized(&calloutParser{}, 100)),
+		parser.WithASTTransformers(util.Prioritized(&calloutTransformer{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&calloutRenderer{}, 500),
+	))
+}
+
+// MATH MARKDOWN EXTENSION
+
+// kindMath identifies math nodes in the Goldmark syntax tree.
+var kindMath = ast.NewNodeKind("Math")
+
+// mathNode holds TeX source from $...$ (inline)
+// or $$...$$ (display) in a page with math: true
+// in its front matter.
+type mathNode struct {
+	ast.BaseInline
+	// TeX source without the dollar signs
+	tex []byte
+	// True for $$...$$
+	display bool
+}
+
+// Kind implements ast.Node.Kind
+func (n *mathNode) Kind() ast.NodeKind {
+	return kindMath
+}
+
+// Dump implements ast.Node.Dump
+func (n *mathNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.tex)}, nil)
+}
+
+// kindMathBlock identifies display math on lines of its own.
+var kindMathBlock = ast.NewNodeKind("MathBlock")
+
+// mathBlock holds display math written on its own lines:
+//
+// $$
+// E = mc^2
+// $$
+type mathBlock struct {
+	ast.BaseBlock
+}
+
+// Kind implements ast.Node.Kind
+func (n *mathBlock) Kind() ast.NodeKind {
+	return kindMathBlock
+}
+
+// Dump implements ast.Node.Dump
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// IsRaw implements ast.Node.IsRaw
+func (n *mathBlock) IsRaw() bool {
+	return true
+}
+
+// mathContextKey holds whether the page being parsed has
+// math: true in its front matter. See newParserContext().
+var mathContextKey = parser.NewContextKey()
+
+// mathEnabled() reports whether the page being parsed has
+// math: true in its front matter. Dollar signs are too common
+// to treat as math everywhere.
+func mathEnabled(pc parser.Context) bool {
+	enabled, _ := pc.Get(mathContextKey).(bool)
+	return enabled
+}
+
+// newParserContext() returns a Goldmark parser context
+// holding the front matter settings the Markdown
+// extensions need.
+func newParserContext(fm map[string]interface{}) parser.Context {
+	pc := parser.NewContext()
+	pc.Set(mathContextKey, fmBool("math", fm))
+	return pc
+}
+
+// mathInlineParser is a Goldmark inline parser for $...$ and $$...$$
+// on a single line. Following Pandoc, the opening $ can't be followed
+// by a space and the closing $ can't be preceded by a space or
+// followed by a digit, so "$5 and $10" stays text.
+type mathInlineParser struct{}
+
+// Trigger implements parser.InlineParser.Trigger
+func (p *mathInlineParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Parse implements parser.InlineParser.Parse
+func (p *mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	if !mathEnabled(pc) {
+		return nil
+	}
+	line, _ := block.PeekLine()
+	delim := 1
+	if len(line) > 1 && line[1] == '$' {
+		delim = 2
+	}
+	if len(line) <= delim || util.IsSpace(line[delim]) {
+		return nil
+	}
+	for i := delim; i+delim <= len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] != '$' || (delim == 2 && line[i+1] != '$') {
+			continue
+		}
+		if util.IsSpace(line[i-1]) {
+			return nil
+		}
+		if delim == 1 && i+1 < len(line) && line[i+1] >= '0' && line[i+1] <= '9' {
+			return nil
+		}
+		node := &mathNode{
+			tex:     append([]byte{}, line[delim:i]...),
+			display: delim == 2,
+		}
+		block.Advance(i + delim)
+		return node
+	}
+	return nil
+}
+
+// mathBlockParser is a Goldmark block parser for display
+// math starting with $$ at the beginning of a line and
+// ending with $$ at the end of a line.
+type mathBlockParser struct{}
+
+// Trigger implements parser.BlockParser.Trigger
+func (b *mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Open implements parser.BlockParser.Open
+func (b *mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !mathEnabled(pc) || !bytes.HasPrefix(line[pos:], []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+	rest := bytes.TrimSpace(line[pos+2:])
+	node := &mathBlock{}
+	switch {
+	case len(rest) == 0:
+		// Opening $$ on a line of its own
+	case bytes.HasSuffix(rest, []byte("$$")):
+		// $$ E = mc^2 $$ all on one line is a paragraph
+		// unless it's the only thing on the line.
+		start := segment.Start + pos + 2
+		node.Lines().Append(text.NewSegment(start, segment.Start+bytes.LastIndex(line, []byte("$$"))))
+		reader.Advance(segment.Len() - trailingNewline(line))
+		return node, parser.Close
+	default:
+		// Math starts on the same line as the opening $$
+		node.Lines().Append(text.NewSegment(segment.Start+pos+2, segment.Stop))
+	}
+	reader.Advance(segment.Len() - trailingNewline(line))
+	return node, parser.NoChildren
+}
+
+// Continue implements parser.BlockParser.Continue
+func (b *mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	line, segment := reader.PeekLine()
+	if line == nil {
+		return parser.Close
+	}
+	trimmed := bytes.TrimRight(line, " \t\r\n")
+	if bytes.HasSuffix(trimmed, []byte("$$")) {
+		// Closing $$, possibly after the last of the math
+		node.Lines().Append(text.NewSegment(segment.Start, segment.Start+len(trimmed)-2))
+		reader.Advance(segment.Len() - trailingNewline(line))
+		return parser.Close
+	}
+	node.Lines().Append(segment)
+	reader.Advance(segment.Len() - trailingNewline(line))
+	return parser.Continue | parser.NoChildren
+}
+
+// Close implements parser.BlockParser.Close
+func (b *mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+// CanInterruptParagraph implements parser.BlockParser.CanInterruptParagraph
+func (b *mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+// CanAcceptIndentedLine implements parser.BlockParser.CanAcceptIndentedLine
+func (b *mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// mathRenderer renders math as TeX source inside elements
+// the bundled script in .poco/js/math finds and typesets:
+//
+//	<span class="math-poco">x^2</span>
+//	<div class="math-poco math-display">E = mc^2</div>
+type mathRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer.RegisterFuncs
+func (r *mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMath, r.renderMath)
+	reg.Register(kindMathBlock, r.renderMathBlock)
+}
+
+func (r *mathRenderer) renderMath(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		node := n.(*mathNode)
+		if node.display {
+			_, _ = w.WriteString(`<span class="math-poco math-display">`)
+		} else {
+			_, _ = w.WriteString(`<span class="math-poco">`)
+		}
+		_, _ = w.Write(util.EscapeHTML(node.tex))
+		_, _ = w.WriteString("</span>")
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *mathRenderer) renderMathBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString(`<div class="math-poco math-display">`)
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			segment := lines.At(i)
+			_, _ = w.Write(util.EscapeHTML(segment.Value(source)))
+		}
+		_, _ = w.WriteString("</div>\n")
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// mathExtension adds $...$ and $$...$$ math to Goldmark
+// for pages with math: true in their front matter.
+type mathExtension struct{}
+
+// Extend implements goldmark.Extender.Extend
+func (e *mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(&mathBlockParser{}, 100)),
+		parser.WithInlineParsers(util.Prioritized(&mathInlineParser{}, 100)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&mathRenderer{}, 500),
+	))
+}
+
+// mathJs() returns the Javascript that typesets math, but
+// only for pages with this in their front matter:
+// ---
+// math: true
+// ---
+// It consists of every .js file in the .poco/js/math
+// directory, in alphabetical order.
+func (c *config) mathJs() string {
+	if !fmBool("math", c.pageFm) {
+		return ""
+	}
+	return c.jsDirString(jsMathDir)
+}
+
+// vendorScripts() returns script tags loading the libraries
+// from .poco/js/vendor the current page needs, to go before
+// the Javascript that uses them.
+func (c *config) vendorScripts() string {
+	s := ""
+	if fmBool("math", c.pageFm) {
+		s += c.vendorScript("katex.min.js")
+	}
+	if c.hasMermaid() {
+		s += c.vendorScript("mermaid.min.js")
+	}
+	return s
+}
+
+// vendorScript() publishes the named library from .poco/js/vendor
+// under a name including a hash of its contents, for example,
+// assets/katex.min.3f9a1c07.js, and returns a script tag for it.
+// Large libraries are kept out of the pages that use them so
+// browsers download them only once.
+func (c *config) vendorScript(name string) string {
+	source := filepath.Join(c.pocoDir, jsDir, jsVendorDir, name)
+	b, err := os.ReadFile(source)
+	if err != nil {
+		quit(1, err, c, "Unable to read %s", source)
+	}
+	ext := filepath.Ext(name)
+	filename := strings.TrimSuffix(name, ext) + "." + hashBytes(b)[:8] + ext
+	c.bundleAssets[filepath.Join(c.webroot, assetsDir, filename)] = source
+	return fmt.Sprintf("<script src=\"/%s/%s\"></script>\n", assetsDir, filename)
+}
+
+// jsDirString() returns the contents of every .js file in
+// the named directory under .poco/js, in alphabetical order.
+func (c *config) jsDirString(dir string) string {
+	filenames, _ := filepath.Glob(filepath.Join(c.pocoDir, jsDir, dir, "*.js"))
+	sort.Strings(filenames)
+	s := ""
+	for _, filename := range filenames {
+		s += c.fileToString(filename)
+	}
+	return s
+}
+
+// DIAGRAM MARKDOWN EXTENSION
+
+// diagramLanguages lists the fenced code block languages
+// rendered as diagrams instead of highlighted code.
+var diagramLanguages = []string{"mermaid", "dot", "plantuml"}
+
+// diagramRe matches the container diagramRenderer emits for
+// diagrams rendered by a local command, such as:
+// <pre class="diagram-poco diagram-dot">digraph { a -> b }</pre>
+var diagramRe = regexp.MustCompile(`(?s)<pre class="diagram-poco diagram-(\w+)">(.*?)</pre>`)
+
+// kindDiagram identifies diagram nodes in the Goldmark syntax tree.
+var kindDiagram = ast.NewNodeKind("Diagram")
+
+// diagram replaces a fenced code block whose
+// language is one of diagramLanguages.
+type diagram struct {
+	ast.BaseBlock
+	// Language of the fenced code block, e.g. mermaid
+	lang string
+}
+
+// Kind implements ast.Node.Kind
+func (n *diagram) Kind() ast.NodeKind {
+	return kindDiagram
+}
+
+// Dump implements ast.Node.Dump
+func (n *diagram) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Lang": n.lang}, nil)
+}
+
+// IsRaw implements ast.Node.IsRaw
+func (n *diagram) IsRaw() bool {
+	return true
+}
+
+// diagramTransformer replaces fenced code blocks like ```mermaid
+// with diagram nodes, so they skip syntax highlighting.
+type diagramTransformer struct{}
+
+// Transform implements parser.ASTTransformer.Transform
+func (t *diagramTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var fences []*ast.FencedCodeBlock
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if fence, ok := n.(*ast.FencedCodeBlock); ok && entering {
+			fences = append(fences, fence)
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, fence := range fences {
+		lang := strings.ToLower(string(fence.Language(reader.Source())))
+		if !slices.Contains(diagramLanguages, lang) {
+			continue
+		}
+		node := &diagram{lang: lang}
+		node.SetLines(fence.Lines())
+		fence.Parent().ReplaceChild(fence.Parent(), fence, node)
+	}
+}
+
+// diagramRenderer renders Mermaid diagrams as the
+// <pre class="mermaid"> elements the Mermaid script looks for,
+// and other diagrams as source for c.renderDiagrams() to
+// pass to a local command. c.renderDiagrams() converts
+// Mermaid diagrams too if the site names a command for them.
+type diagramRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer.RegisterFuncs
+func (r *diagramRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindDiagram, r.renderDiagram)
+}
+
+func (r *diagramRenderer) renderDiagram(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	node := n.(*diagram)
+	if node.lang == "mermaid" {
+		_, _ = w.WriteString(`<pre class="mermaid diagram-poco">`)
+	} else {
+		_, _ = w.WriteString(`<pre class="diagram-poco diagram-` + node.lang + `">`)
+	}
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		_, _ = w.Write(util.EscapeHTML(segment.Value(source)))
+	}
+	_, _ = w.WriteString("</pre>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// diagramExtension turns ```mermaid, ```dot, and ```plantuml
+// fenced code blocks into diagrams.
+type diagramExtension struct{}
+
+// Extend implements goldmark.Extender.Extend
+func (e *diagramExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(
+		util.Prioritized(&diagramTransformer{}, 100),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(&diagramRenderer{}, 500),
+	))
+}
+
+// diagramCommand() returns the local command that converts
+// diagrams in language lang to SVG. It's set for the whole
+// site in the home page's front matter:
+// ---
+// diagrams:
+//
+//	dot: "dot -Tsvg"
+//	plantuml: "plantuml -tsvg -pipe"
+//
+// ---
+// Other pages can't name commands, so building a page
+// never runs anything the site owner didn't set up.
+// Returns "" if there's no command for lang.
+func (c *config) diagramCommand(lang string) string {
+	return fmMap("diagrams", c.globalFm)[lang]
+}
+
+// renderDiagrams() replaces the source of each diagram in
+// article with the SVG produced by the local command set
+// up for its language with diagramCommand(). The diagram
+// source is passed on standard input and the SVG is read
+// from standard output. Diagrams without a command are left
+// as preformatted source, and Mermaid diagrams without one
+// are left for the Mermaid script.
+func (c *config) renderDiagrams(article string) string {
+	if c.diagramCommand("mermaid") != "" {
+		article = strings.ReplaceAll(article, `<pre class="mermaid diagram-poco">`, `<pre class="diagram-poco diagram-mermaid">`)
+	}
+	return diagramRe.ReplaceAllStringFunc(article, func(pre string) string {
+		m := diagramRe.FindStringSubmatch(pre)
+		lang, source := m[1], htmlstd.UnescapeString(m[2])
+		args := strings.Fields(c.diagramCommand(lang))
+		if len(args) == 0 {
+			return pre
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(source)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			quit(1, err, c, "%s: unable to render %s diagram with \"%s\": %s", c.currentFilename, lang, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+		svg := string(out)
+		// Drop any XML declaration and doctype preceding the SVG
+		if pos := strings.Index(svg, "<svg"); pos > 0 {
+			svg = svg[pos:]
+		}
+		return `<div class="diagram-poco diagram-` + lang + `">` + strings.TrimSpace(svg) + "</div>"
+	})
+}
+
+// diagramJs() returns the Javascript that draws Mermaid
+// diagrams, but only for pages that contain them.
+// It consists of every .js file in the .poco/js/diagram
+// directory, in alphabetical order.
+func (c *config) diagramJs() string {
+	if !c.hasMermaid() {
+		return ""
+	}
+	return c.jsDirString(jsDiagramDir)
+}
+
+// hasMermaid() reports whether the current page, including
+// its layout elements, contains Mermaid diagrams left for
+// the Mermaid script to draw.
+func (c *config) hasMermaid() bool {
+	return strings.Contains(c.pageHTML(), `<pre class="mermaid diagram-poco">`)
+}
+
+// SHORTCODE UTILITIES
+
+// shortcodeRe matches a shortcode tag, either an opening tag
+// with optional parameters such as
+//
+//	{{< callout type="warning" >}}
+//
+// or a closing tag such as
+//
+//	{{< /callout >}}
+var shortcodeRe = regexp.MustCompile(`\{\{<\s*(/?)([\w-]+)((?:\s+[^>]*?)?)\s*>\}\}`)
+
+// escapedShortcodeRe matches a shortcode commented out so it
+// appears on the page as written, for example
+//
+//	{{</* callout */>}}
+//
+// appears as {{< callout >}}.
+var escapedShortcodeRe = regexp.MustCompile(`(?s)\{\{</\*(.*?)\*/>\}\}`)
+
+// fenceRe matches the opening or closing line of a fenced code block.
+var fenceRe = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+// literalBraces stands in for {{ that must appear on the page
+// as is, in shortcodes that are escaped or inside fenced code.
+// Otherwise it would start a template action. doTemplate()
+// turns it back into {{. It's a Unicode private use character,
+// so it won't turn up in real text.
+const literalBraces = "\uE000"
+
+// protectShortcodes() keeps shortcodes in source from being
+// expanded if they're escaped or inside fenced code blocks.
+func protectShortcodes(source []byte) []byte {
+	source = escapedShortcodeRe.ReplaceAll(source, []byte(literalBraces+"<$1>}}"))
+	lines := bytes.SplitAfter(source, []byte("\n"))
+	fence := ""
+	for i, line := range lines {
+		if m := fenceRe.FindSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = string(m[1])
+			case m[1][0] == fence[0] && len(m[1]) >= len(fence) &&
+				len(bytes.TrimSpace(line)) == len(m[1]):
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			lines[i] = bytes.ReplaceAll(line, []byte("{{<"), []byte(literalBraces+"<"))
+		}
+	}
+	return bytes.Join(lines, nil)
+}
+
+// preTagRe matches the start or end tag of a pre or
+// textarea element, where whitespace matters.
+var preTagRe = regexp.MustCompile(`(?i)<(/?)(?:pre|textarea)\b`)
+
+// keepInHTMLBlock() removes blank lines from the HTML output
+// of a shortcode. A blank line would end the HTML block early,
+// and what followed would be treated as Markdown. Blank lines
+// inside pre and textarea elements are kept by writing them
+// as character references at the start of the next line.
+func keepInHTMLBlock(html string) string {
+	lines := []string{}
+	depth := 0
+	blank := ""
+	for _, line := range strings.Split(html, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if depth > 0 {
+				for _, r := range line {
+					blank += fmt.Sprintf("&#%d;", r)
+				}
+				blank += "&#10;"
+			}
+			continue
+		}
+		lines = append(lines, blank+line)
+		blank = ""
+		for _, m := range preTagRe.FindAllStringSubmatch(line, -1) {
+			if m[1] == "" {
+				depth++
+			} else if depth > 0 {
+				depth--
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shortcodeParamRe matches one shortcode parameter: either
+// key="value", key=value, or a positional "value" or value.
+var shortcodeParamRe = regexp.MustCompile(`(?:([\w-]+)=)?(?:"([^"]*)"|(\S+))`)
+
+// shortcode is what a partial template receives
+// when a shortcode is expanded. The partial for
+//
+//	{{< callout "Careful" type="warning" >}}Don't *do* that{{< /callout >}}
+//
+// lives in partials/callout.html and might look like this:
+//
+//	<div class="callout {{.Params.type}}">
+//	<strong>{{index .Args 0}}</strong>{{.Inner}}
+//	</div>
+type shortcode struct {
+	// Name of the shortcode, which is also the partial's filename
+	Name string
+
+	// Positional parameters
+	Args []string
+
+	// Named parameters
+	Params map[string]string
+
+	// Content between the opening and closing tags,
+	// converted from Markdown to HTML
+	Inner template.HTML
+
+	// Front matter for this page
+	Page map[string]interface{}
+
+	// Front matter for the home page
+	Site map[string]interface{}
+}
+
+// parseShortcodeParams() splits the parameter portion of a
+// shortcode tag into positional and named parameters.
+func parseShortcodeParams(params string) ([]string, map[string]string) {
+	args := []string{}
+	named := map[string]string{}
+	for _, m := range shortcodeParamRe.FindAllStringSubmatch(params, -1) {
+		value := m[2] + m[3]
+		if m[1] != "" {
+			named[m[1]] = value
+		} else {
+			args = append(args, value)
+		}
+	}
+	return args, named
+}
+
+// partialFilename() finds the partial for the named shortcode.
+// The project's partials directory comes first, so users can
+// override the partials in a theme. Then the page theme's
+// directory, then the global theme's.
+// Returns "" if there is no such partial.
+func (c *config) partialFilename(name string) string {
+	dirs := []string{filepath.Join(c.root, partialsDir)}
+	if c.pageTheme.present {
+		dirs = append(dirs, filepath.Join(c.pageTheme.dir, partialsDir))
+	}
+	if c.theme.present {
+		dirs = append(dirs, filepath.Join(c.theme.dir, partialsDir))
+	}
+	for _, dir := range dirs {
+		filename := filepath.Join(dir, name+".html")
+		if fileExists(filename) {
+			return filename
+		}
+	}
+	return ""
+}
+
+// expandShortcodes() replaces every shortcode in source
+// with the output of its partial template. A shortcode with
+// a matching closing tag has the text between them converted
+// from Markdown and passed to the partial as .Inner.
+// Shortcodes may be nested. Shortcodes in fenced code blocks
+// and escaped ones like {{</* callout */>}} are left as is.
+func (c *config) expandShortcodes(source []byte) ([]byte, error) {
+	// Fast path: most pages don't use shortcodes.
+	if !bytes.Contains(source, []byte("{{<")) {
+		return source, nil
+	}
+	source = protectShortcodes(source)
+	var out bytes.Buffer
+	for {
+		loc := shortcodeRe.FindSubmatchIndex(source)
+		if loc == nil {
+			out.Write(source)
+			break
+		}
+		out.Write(source[:loc[0]])
+		name := string(source[loc[4]:loc[5]])
+		if loc[3] > loc[2] {
+			return nil, fmt.Errorf("closing shortcode %s has no opening shortcode", name)
+		}
+		params := string(source[loc[6]:loc[7]])
+		rest := source[loc[1]:]
+
+		// Find the matching closing tag, if any, allowing for
+		// shortcodes of the same name nested inside.
+		var inner []byte
+		hasInner := false
+		depth := 0
+		for _, m := range shortcodeRe.FindAllSubmatchIndex(rest, -1) {
+			if string(rest[m[4]:m[5]]) != name {
+				continue
+			}
+			if m[3] == m[2] {
+				depth++
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			inner = rest[:m[0]]
+			rest = rest[m[1]:]
+			hasInner = true
+			break
+		}
+
+		html, err := c.executeShortcode(name, params, inner, hasInner)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString(html)
+		source = rest
+	}
+	return out.Bytes(), nil
+}
+
+// executeShortcode() runs the partial for one shortcode and
+// returns its output. The include and code shortcodes are
+// built in and don't use partials.
+func (c *config) executeShortcode(name, params string, inner []byte, hasInner bool) (string, error) {
+	switch name {
+	case "include":
+		return c.includeMarkdown(params)
+	case "code":
+		return c.includeCode(params)
+	}
+	var innerHTML string
+	if hasInner {
+		// Inner content may contain shortcodes of its own.
+		expanded, err := c.expandShortcodes(inner)
+		if err != nil {
+			return "", err
+		}
+		b, _, err := mdYAMLToHTML(expanded)
+		if err != nil {
+			return "", err
+		}
+		innerHTML = strings.TrimSpace(string(b))
+	}
+	filename := c.partialFilename(name)
+	if filename == "" {
+		return "", fmt.Errorf("can't find a partial named %s.html for shortcode %s", name, name)
+	}
+	tmpl, err := template.New(name).Funcs(c.funcs).Parse(string(fileToBuf(filename)))
+	if err != nil {
+		return "", err
+	}
+	args, named := parseShortcodeParams(params)
+	data := shortcode{
+		Name:   name,
+		Args:   args,
+		Params: named,
+		Inner:  template.HTML(innerHTML),
+		Page:   c.pageFm,
+		Site:   c.globalFm,
+	}
+	buf := new(bytes.Buffer)
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return keepInHTMLBlock(buf.String()), nil
+}
+
+// INCLUDE UTILITIES
+
+// codeRegionRe matches a comment marking the start or end
+// of a region of source code for the code shortcode, e.g.
+// // region setup
+// # endregion setup
+// <!-- region setup -->
+var codeRegionRe = regexp.MustCompile(`^\s*(?://|#|--|<!--|/\*|;|%)\s*#?(end)?region\b\s*([\w-]*)`)
+
+// readInclude() reads a file named by the include or code
+// shortcode. Filenames are relative to the project root,
+// so the same shortcode works on any page. Files in the
+// partials directory aren't published on their own,
+// which makes it a good home for shared Markdown.
+// The file is pushed onto c.includeStack, and the caller
+// has to pop it off when done. Returns an error if the file
+// is outside the project, or is already being included,
+// which would never end.
+func (c *config) readInclude(params string) (string, map[string]string, []byte, error) {
+	args, named := parseShortcodeParams(params)
+	name := named["file"]
+	if name == "" && len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		return "", nil, nil, fmt.Errorf("include needs a filename")
+	}
+	filename := filepath.Join(c.root, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(c.root, filename); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", nil, nil, fmt.Errorf("included file %s is outside the project", name)
+	}
+	chain := append([]string{c.currentFilename}, c.includeStack...)
+	if slices.Contains(chain, filename) {
+		for i := range chain {
+			chain[i] = c.relToRoot(chain[i])
+		}
+		return "", nil, nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), name)
+	}
+	if !fileExists(filename) {
+		return "", nil, nil, fmt.Errorf("can't find included file %s", name)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	c.addDependency(c.relToRoot(filename))
+	c.includeStack = append(c.includeStack, filename)
+	return name, named, b, nil
+}
+
+// relToRoot() returns filename relative to the project root
+// if possible, so messages are easier to read.
+func (c *config) relToRoot(filename string) string {
+	if rel, err := filepath.Rel(c.root, filename); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filename
+}
+
+// addDependency() records that the current page includes
+// the file rel, relative to the project root.
+func (c *config) addDependency(rel string) {
+	if c.dependencies == nil {
+		c.dependencies = map[string][]string{}
+	}
+	if slices.Contains(c.dependencies[c.currentFilename], rel) {
+		return
+	}
+	c.dependencies[c.currentFilename] = append(c.dependencies[c.currentFilename], rel)
+	c.verbose("\tincludes %s", rel)
+}
+
+// includeMarkdown() implements the include shortcode, which
+// inserts another Markdown file into the page before it's
+// converted:
+//
+//	{{< include "partials/install.md" >}}
+//
+// The included file's front matter is left out. It can
+// include other files in turn.
+func (c *config) includeMarkdown(params string) (string, error) {
+	name, _, b, err := c.readInclude(params)
+	if err != nil {
+		return "", err
+	}
+	defer func() { c.includeStack = c.includeStack[:len(c.includeStack)-1] }()
+	_, body := parseFrontMatter(b)
+	expanded, err := c.expandShortcodes(body)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return strings.TrimRight(string(expanded), "\n"), nil
+}
+
+// includeCode() implements the code shortcode, which inserts
+// a source file, or part of one, as a fenced code block:
+//
+//	{{< code "src/main.go" >}}
+//	{{< code "src/main.go" lines="10-20" >}}
+//	{{< code "src/main.go" region="setup" lang="go" linenos="table" >}}
+//
+// lines takes a line number or range, like 10, 10-20, or 10-.
+// region takes the lines between comments marking it:
+//
+//	// region setup
+//	...
+//	// endregion setup
+//
+// lang defaults to the file's extension. linenos numbers
+// the lines starting from where the excerpt begins.
+func (c *config) includeCode(params string) (string, error) {
+	name, named, b, err := c.readInclude(params)
+	if err != nil {
+		return "", err
+	}
+	c.includeStack = c.includeStack[:len(c.includeStack)-1]
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	first := 1
+	if region := named["region"]; region != "" {
+		if first, lines, err = codeRegion(lines, region); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+	} else if r := named["lines"]; r != "" {
+		if first, lines, err = codeLines(lines, r); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	// Source code such as []T{{1}} isn't template code
+	code := strings.ReplaceAll(dedent(lines), "{{", literalBraces)
+
+	lang := named["lang"]
+	if lang == "" {
+		lang = strings.TrimPrefix(filepath.Ext(name), ".")
+	}
+	info := lang
+	if linenos := named["linenos"]; linenos != "" {
+		info += fmt.Sprintf(" {linenos=%s,linenostart=%d}", linenos, first)
+	}
+	// The fence has to be longer than any run
+	// of backticks in the code.
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fence + info + "\n" + code + "\n" + fence, nil
+}
+
+// codeLines() returns the lines in the range r, such as
+// 10, 10-20, or 10-, counting from 1, and the number
+// of the first line returned.
+func codeLines(lines []string, r string) (int, []string, error) {
+	from, to, isRange := strings.Cut(r, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad line range %s", r)
+	}
+	last := first
+	if isRange {
+		last = len(lines)
+		if to = strings.TrimSpace(to); to != "" {
+			if last, err = strconv.Atoi(to); err != nil {
+				return 0, nil, fmt.Errorf("bad line range %s", r)
+			}
+		}
+	}
+	if first < 1 || last > len(lines) || first > last {
+		return 0, nil, fmt.Errorf("line range %s is outside lines 1-%d", r, len(lines))
+	}
+	return first, lines[first-1 : last], nil
+}
+
+// codeRegion() returns the lines between the comments
+// marking the start and end of the named region, and the
+// number of the first line returned. Lines marking any other
+// regions nested inside are left out.
+func codeRegion(lines []string, name string) (int, []string, error) {
+	first := 0
+	region := []string{}
+	for i, line := range lines {
+		m := codeRegionRe.FindStringSubmatch(line)
+		switch {
+		case first == 0 && m != nil && m[1] == "" && m[2] == name:
+			first = i + 2
+		case first == 0:
+		case m != nil && m[1] == "end" && (m[2] == name || m[2] == ""):
+			return first, region, nil
+		case m == nil:
+			region = append(region, line)
+		}
+	}
+	if first == 0 {
+		return 0, nil, fmt.Errorf("can't find region %s", name)
+	}
+	return 0, nil, fmt.Errorf("region %s has no endregion", name)
+}
+
+// dedent() removes the indentation shared by all
+// non-blank lines and joins them.
+func dedent(lines []string) string {
+	indent := ""
+	found := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lead := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			indent, found = lead, true
+			continue
+		}
+		for !strings.HasPrefix(lead, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isFrontMatterSeparator() returns true if line is made
+// up of dashes, like the --- around front matter.
+func isFrontMatterSeparator(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	return len(line) > 0 && len(bytes.Trim(line, "-")) == 0
+}
+
+// parseFrontMatter() splits Markdown source into its
+// front matter, parsed as YAML, and the Markdown that
+// follows it. Front matter that isn't valid YAML is left
+// in the Markdown, and the front matter returned is empty.
+func parseFrontMatter(source []byte) (map[string]interface{}, []byte) {
+	fm := map[string]interface{}{}
+	lines := bytes.SplitAfter(source, []byte("\n"))
+	if !isFrontMatterSeparator(lines[0]) {
+		return fm, source
+	}
+	for i := 1; i < len(lines); i++ {
+		if isFrontMatterSeparator(lines[i]) {
+			if err := yaml.Unmarshal(bytes.Join(lines[1:i], nil), &fm); err != nil {
+				return map[string]interface{}{}, source
+			}
+			return fm, bytes.Join(lines[i+1:], nil)
+		}
+	}
+	return fm, source
+}
+
+// PARSING UTILITIES
+
+// convertMdYAMLFileToHTMLFragmentStr converts the Markdown code fragment,
+// which may have front matter, to HTML.
+// It doesn't execute templates.
+// It doesn't assemble the file--that its, no header, footer, etc.
+// So "hello, world" should come back as "<p>hello, world</p>"
+// Returns parsed file as HTML.
+func convertMdYAMLFileToHTMLFragmentStr(filename string, c *config) string {
+	b, err := c.expandShortcodes([]byte(c.fileToString(filename)))
+	if err != nil {
+		quit(1, err, c, "%s: shortcode error", filename)
+	}
+	fm, body := parseFrontMatter(b)
+	source := string(body)
+	safe := c.safeHTML()
+	mdParser := newGoldmark(safe, c.highlightOptions()...)
+	mdParserCtx := newParserContext(fm)
+	// Build a syntax tree (intermediate representation)
+	// for the input Markdown text.
+	_ = mdParser.Parser().Parse(text.NewReader([]byte(source)))
+	var buf bytes.Buffer
+	// Convert syntax tree to HTML and deposit in buf.Bytes().
+	if err := mdParser.Convert([]byte(source), &buf, parser.WithContext(mdParserCtx)); err != nil {
+		quit(1, err, c, "Unable to convert Markdown to HTML")
+	}
+	c.reportViolations(filename, safe)
+	return string(buf.Bytes())
+}
+
+// mdYAMLFileToHTMLString converts a Markdown document
+// with YAML front matter to HTML.
+// The HTML file has not yet had templates executed,
+// Destructive: replaces c.fm
+// Returns a byte slice containing the HTML source.
+func mdYAMLFileToHTMLString(c *config, filename string) (string, error) {
+	source, err := c.expandShortcodes(fileToBuf(filename))
+	if err != nil {
+		return "", err
+	}
+	var HTML []byte
+	safe := c.safeHTML()
+	if HTML, c.fm, c.headings, err = mdYAMLToHTMLWithHeadings(source, safe, c.highlightOptions()...); err != nil {
+		return "", err
+	} else {
+		c.reportViolations(filename, safe)
+		return string(HTML), nil
+	}
+}
+
+// newGoldmark() allocates a Goldmark parser with a
+// raft of other options. Syntax highlighting uses
+// the autumn style with inline styles unless
+// highlighting options are passed in. Raw HTML
+// is passed through as is unless safe is non-nil.
+func newGoldmark(safe *htmlSanitizer, hl ...highlighting.Option) goldmark.Markdown {
+	if len(hl) == 0 {
+		hl = []highlighting.Option{
+			highlighting.WithStyle(defaultHighlightStyle),
+			highlighting.WithFormatOptions()}
+	}
+	exts := []goldmark.Extender{
+		// Support GitHub tables & other extensions
+		extension.Table,
+		extension.GFM,
+		extension.DefinitionList,
+		extension.Footnote,
+		extension.Linkify,
+		// YouTube embedding
+		ytembed.New(),
+		// > [!NOTE] alerts and :::tip blocks
+		&calloutExtension{},
+		// $...$ and $$...$$ on pages with math: true
+		&mathExtension{},
+		// ```mermaid and other diagrams
+		&diagramExtension{},
+		highlighting.NewHighlighting(hl...),
+	}
+	// safehtml: strip or sanitize
+	if safe != nil {
+		exts = append(exts, &safeHTMLExtension{s: safe})
+	}
+
+	parserOpts := []parser.Option{
+		parser.WithAttribute(),
+		parser.WithAutoHeadingID()}
+
+	renderOpts := []renderer.Option{
+		html.WithUnsafe(),
+		// html.WithHardWraps(),
+		html.WithXHTML(),
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(parserOpts...),
+		goldmark.WithRendererOptions(renderOpts...),
+	)
+}
+
+// SYNTAX HIGHLIGHTING UTILITIES
+
+// Chroma style used for fenced code blocks
+// unless the front matter names another.
+const defaultHighlightStyle = "autumn"
+
+// Chroma style used for fenced code blocks in dark mode
+// when highlighting with CSS classes and the front
+// matter doesn't name one.
+const defaultHighlightDarkStyle = "monokai"
+
+// highlightSettings() reads syntax highlighting settings
+// from front matter, either just a style name:
+// ---
+// highlight: monokailight
+// ---
+// or a map:
+//
+//	---
+//	highlight:
+//	  style: github
+//	  dark: dracula
+//	  classes: true
+//	  linenos: true
+//	---
+//
+// style and dark are Chroma style names. dark is used
+// when the visitor prefers a dark color scheme, which
+// requires classes: true. With classes: true, code is marked
+// up with CSS classes instead of inline styles and Poco
+// generates the stylesheet for them. linenos: true numbers
+// the lines of every fenced code block.
+func highlightSettings(fm map[string]interface{}) map[string]string {
+	if style := fmStr("highlight", fm); style != "" {
+		return map[string]string{"style": style}
+	}
+	return fmMap("highlight", fm)
+}
+
+// highlightSetting() returns the named syntax highlighting
+// setting from the page's front matter, or if it's not there,
+// the theme's README.md, or if not there, the home page.
+func (c *config) highlightSetting(key string) string {
+	if v := highlightSettings(c.pageFm)[key]; v != "" {
+		return v
+	}
+	if t := c.activeTheme(); t != nil {
+		if v := t.highlight[key]; v != "" {
+			return v
+		}
+	}
+	return highlightSettings(c.globalFm)[key]
+}
+
+// highlightStyle() returns the Chroma style for fenced code
+// blocks. dark selects the dark mode style.
+func (c *config) highlightStyle(dark bool) string {
+	if dark {
+		if style := c.highlightSetting("dark"); style != "" {
+			return style
+		}
+		return defaultHighlightDarkStyle
+	}
+	if style := c.highlightSetting("style"); style != "" {
+		return style
+	}
+	return defaultHighlightStyle
+}
+
+// highlightClasses() returns true if fenced code
+// blocks use CSS classes instead of inline styles.
+func (c *config) highlightClasses() bool {
+	return isTrue(c.highlightSetting("classes"))
+}
+
+// highlightOptions() returns the Goldmark highlighting
+// options for the current page. Individual fenced code
+// blocks can add line numbers and highlight lines
+// with attributes after the language:
+//
+// ```go {linenos=table,hl_lines=[2,"4-5"],linenostart=10}
+func (c *config) highlightOptions() []highlighting.Option {
+	formatOptions := []chromahtml.Option{}
+	if c.highlightClasses() {
+		formatOptions = append(formatOptions, chromahtml.WithClasses(true))
+	}
+	if isTrue(c.highlightSetting("linenos")) {
+		formatOptions = append(formatOptions, chromahtml.WithLineNumbers(true))
+	}
+	return []highlighting.Option{
+		highlighting.WithStyle(c.highlightStyle(false)),
+		highlighting.WithFormatOptions(formatOptions...),
+	}
+}
+
+// highlightCSS() returns the stylesheet for fenced code
+// blocks marked up with CSS classes: the light style,
+// then the dark style for visitors who prefer a dark
+// color scheme. Returns "" unless the page uses
+// classes and has highlighted code somewhere on it.
+func (c *config) highlightCSS() string {
+	if !c.highlightClasses() || !strings.Contains(c.pageHTML(), `class="chroma"`) {
+		return ""
+	}
+	formatter := chromahtml.New(chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(true),
+		chromahtml.LineNumbersInTable(true))
+	var light, dark bytes.Buffer
+	_ = formatter.WriteCSS(&light, styles.Get(c.highlightStyle(false)))
+	_ = formatter.WriteCSS(&dark, styles.Get(c.highlightStyle(true)))
+	return light.String() + "@media (prefers-color-scheme:dark){\n" + dark.String() + "}\n"
+}
+
+// pageHTML() returns the converted HTML of everything on
+// the current page: the article, the page layout elements,
+// and the theme's regions, which include anything their
+// shortcodes brought in.
+func (c *config) pageHTML() string {
+	s := c.articleRawHTML + c.header() + c.nav() + c.aside() + c.footer()
+	if t := c.activeTheme(); t != nil {
+		for _, r := range t.regions {
+			s += r.html
+		}
+	}
+	return s
+}
+
+// mdYAMLStringToTemplatedHTMLString() takes raw HTML, converts to Markdown,
+// and executes templates. Returns a string of the result.
+// It doesn't assemble the file--that its, no header, footer, etc.
+// So "hello, world" should come back as "<p>hello, world</p>"
+// This should too:
+// ---
+// description: "world"
+// ---
+// hello, {{ .description }}.
+//
 // Returns parsed file as HTML.
 // aside, etc.
 //
-// Replaces contents of c.fm.
-func mdYAMLStringToTemplatedHTMLString(c *config, filename string, markdown string) string {
-	var parsedHTML string
-	var err error
-	var b []byte
-	if b, c.fm, err = mdYAMLToHTML([]byte(markdown)); err != nil {
-		quit(1, err, c, "Unable to convert markdown to raw HTML")
+// Replaces contents of c.fm.
+func mdYAMLStringToTemplatedHTMLString(c *config, filename string, markdown string) string {
+	var parsedHTML string
+	var err error
+	var b []byte
+	if b, c.fm, err = mdYAMLToHTML([]byte(markdown)); err != nil {
+		quit(1, err, c, "Unable to convert markdown to raw HTML")
+	}
+	if parsedHTML, err = doTemplate(filename, string(b), c); err != nil {
+		quit(1, err, c, "%v: Problem executing template code", filename)
+	}
+	return parsedHTML
+}
+
+// mdYAMLtoHTML converts the Markdown file, which may
+// have front matter, to HTML. The  front matter
+// is one of the return values.
+func mdYAMLToHTML(source []byte) ([]byte, map[string]interface{}, error) {
+	HTML, metaData, _, err := mdYAMLToHTMLWithHeadings(source, nil)
+	return HTML, metaData, err
+}
+
+// mdYAMLToHTMLWithHeadings is mdYAMLToHTML, but it also
+// returns every heading in the document for use in
+// a table of contents. Raw HTML is sanitized if safe
+// is non-nil. Optional highlighting options
+// replace the default syntax highlighting.
+func mdYAMLToHTMLWithHeadings(source []byte, safe *htmlSanitizer, hl ...highlighting.Option) ([]byte, map[string]interface{}, []heading, error) {
+
+	// Obtain YAML front matter and the Markdown following it.
+	metaData, source := parseFrontMatter(source)
+	mdParser := newGoldmark(safe, hl...)
+	mdParserCtx := newParserContext(metaData)
+
+	// Build a syntax tree (intermediate representation)
+	// for the input Markdown text.
+	document := mdParser.Parser().Parse(text.NewReader(source), parser.WithContext(mdParserCtx))
+	headings := collectHeadings(document, source)
+	var buf bytes.Buffer
+	// Convert syntax tree to HTML and deposit in buf.Bytes().
+	if err := mdParser.Renderer().Render(&buf, source, document); err != nil {
+		return []byte{}, nil, nil, err
+	}
+	return buf.Bytes(), metaData, headings, nil
+}
+
+// PROMPT UTILITIES
+// See also wait(), which prints a message and awaits 'q' or Enter.
+
+// inputString() gets a string from the keyboard and returns it
+// See also promptString()
+func inputString() string {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	return scanner.Text()
+}
+
+// promptString() displays a prompt, then awaits for keyboard
+// input and returns it on completion.
+// See also inputString(), promptYes()
+func promptString(format string, ss ...interface{}) string {
+	fmt.Print(fmtMsg(format, ss...))
+	fmt.Print(" ")
+	return inputString()
+}
+
+// promptStringDefault() displays a prompt, then awaits for keyboard
+// input and returns it on completion. It precedes the end of the
+// prompt with a default value in brackets.
+// See also inputString(), promptYes()
+func promptStringDefault(prompt string, defaultValue string) string {
+	answer := promptString(prompt + " [" + defaultValue + "] ")
+	if answer == "" {
+		return defaultValue
+	} else {
+		return answer
+	}
+}
+
+// SERVER UTILITIES
+
+// serve is the world's simplest web server, for quick tests
+// only. c.port is a string like ":12345" and c.webroot is the
+// pathname of the directory to serve static files from.
+func (c *config) serve() {
+	if !strings.HasPrefix(c.port, ":") {
+		c.port = ":" + c.port
+	}
+	if portBusy(c.port) {
+		print("Port %s is already in use", c.port)
+		os.Exit(1)
+	}
+	if err := os.Chdir(c.webroot); err != nil {
+		quit(1, err, c, "Unable to change to webroot directory %s", c.root)
+	}
+	// Simple static webserver:
+	print("\n%s Web server running at:\n\nhttp://localhost%s\n\nTo stop the web server, press Ctrl+C", theTime(), c.port)
+	if err := http.ListenAndServe(c.port, c.devServer()); err != nil {
+		quit(1, err, c, "Error running web server")
+	}
+}
+
+// devServer() returns the handler used by serve(). It serves
+// files from c.webroot, sends aliases to their pages with a
+// permanent redirect, and responds to missing paths with
+// the not-found page and a 404 status.
+func (c *config) devServer() http.Handler {
+	root := http.Dir(c.webroot)
+	files := http.FileServer(root)
+	aliases := map[string]string{}
+	list, _ := c.redirects()
+	for _, a := range list {
+		aliases[path.Clean(a.From)] = a.To
+		aliases[a.file] = a.To
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+		if to, ok := aliases[urlPath]; ok {
+			http.Redirect(w, r, to, http.StatusMovedPermanently)
+			return
+		}
+		if f, err := root.Open(urlPath); err == nil {
+			f.Close()
+			files.ServeHTTP(w, r)
+			return
+		}
+		page := c.notFoundURL(urlPath)
+		html, err := os.ReadFile(filepath.Join(c.webroot, filepath.FromSlash(page)))
+		if page == "" || err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(html)
+	})
+}
+
+// theTime returns the current time as a string.
+// Nothing configurable b/c it's just used for timestamping
+// every page, a dumb diagnostic tool
+func theTime() string {
+	t := time.Now()
+	s := fmt.Sprintf("%s", t.Format("02 Jan 2006 15:04:05"))
+	return s
+}
+
+// portBusy() returns true if the port
+// (in the form ":12345" is already in use.
+func portBusy(port string) bool {
+	ln, err := net.Listen("tcp", port)
+	if err != nil {
+		return true
+	}
+	err = ln.Close()
+	if err != nil {
+		quit(1, err, nil, "Problem closing port")
+	}
+
+	return false
+}
+
+// MINIFY
+
+// METADATA UTILITIES/FRONT MATTER UTILITIES
+
+// fmStr is passed a front matter "type" and retrievs
+// the value for the value passed in as key. Value
+// is case-insensitive.
+func fmStr(key string, fm map[string]interface{}) string {
+	v := fm[strings.ToLower(key)]
+	value, ok := v.(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+// fmBool is passed a front matter "type" and retrieves
+// the value for key as a boolean. true, yes, and on count
+// as true, in quotes or not.
+func fmBool(key string, fm map[string]interface{}) bool {
+	switch v := fm[strings.ToLower(key)].(type) {
+	case bool:
+		return v
+	case string:
+		return isTrue(v)
+	}
+	return false
+}
+
+// isTrue() returns true if s is true, yes, or on,
+// in any case.
+func isTrue(s string) bool {
+	s = strings.ToLower(s)
+	return s == "true" || s == "yes" || s == "on"
+}
+
+// fmInt is passed a front matter "type" and retrieves
+// the value for key as an integer. Returns 0 if
+// the key is missing or isn't a number.
+func fmInt(key string, fm map[string]interface{}) int {
+	switch v := fm[strings.ToLower(key)].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	return 0
+}
+
+// fmStrSlice obtains a list of string values from the supplied front matter.
+// For example, if you had this code in your Markdown file:
+// ---
+// Stylesheets
+//   - 'https://cdn.jsdelivr.net/npm/holiday.css'
+//   - 'fonts.css'
+//
+// ---
+
+func fmStrSlice(key string, fm map[string]interface{}) []string {
+	if key == "" {
+		return []string{}
+	}
+	v, ok := fm[strings.ToLower(key)].([]interface{})
+	if !ok {
+		return []string{}
+	}
+	s := make([]string, len(v))
+	for i, value := range v {
+		r := fmt.Sprintf("%s", value)
+		s[i] = r
+	}
+	return s
+}
+
+// fmMapSlice obtains a list of key/value pairs from the supplied
+// front matter. For example, if you had this code in your Markdown file:
+// ---
+// regions:
+//   - name: hero
+//     tag: section
+//
+// ---
+// fmMapSlice("regions", fm) would return
+// []map[string]string{{"name": "hero", "tag": "section"}}
+// Keys are forced to lowercase.
+func fmMapSlice(key string, fm map[string]interface{}) []map[string]string {
+	v, ok := fm[strings.ToLower(key)].([]interface{})
+	if !ok {
+		return []map[string]string{}
+	}
+	list := []map[string]string{}
+	for _, item := range v {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		pairs := map[string]string{}
+		for k, value := range m {
+			pairs[strings.ToLower(fmt.Sprintf("%v", k))] = fmt.Sprintf("%v", value)
+		}
+		list = append(list, pairs)
+	}
+	return list
+}
+
+// fmMap obtains key/value pairs from the supplied front
+// matter. For example, if you had this code in your Markdown file:
+// ---
+// diagrams:
+//
+//	dot: "dot -Tsvg"
+//
+// ---
+// fmMap("diagrams", fm) would return
+// map[string]string{"dot": "dot -Tsvg"}
+// Keys are forced to lowercase.
+func fmMap(key string, fm map[string]interface{}) map[string]string {
+	pairs := map[string]string{}
+	m, ok := fm[strings.ToLower(key)].(map[interface{}]interface{})
+	if !ok {
+		return pairs
+	}
+	for k, value := range m {
+		pairs[strings.ToLower(fmt.Sprintf("%v", k))] = fmt.Sprintf("%v", value)
+	}
+	return pairs
+}
+
+// themeDirContents() returns a list of all installed themes
+// separated by newlines
+func (c *config) themeDirContents() string {
+	files, err := ioutil.ReadDir(filepath.Join(pocoDir, "themes"))
+	if err != nil {
+		return ""
+	}
+
+	// Return value: the list of files
+	var s string
+	for _, f := range files {
+		file := f.Name()
+		s = s + fmt.Sprintf("%s\n", file)
+	}
+	return s
+}
+
+// TABLE OF CONTENTS UTILITIES
+
+// Placeholder for the table of contents in a Markdown page.
+// It must be on a line by itself.
+const tocMarker = "<p>[TOC]</p>"
+
+// heading is one heading found in a Markdown document.
+type heading struct {
+	level int
+	id    string
+	title string
+}
+
+// tocEntry is a heading in the table of contents along
+// with the smaller headings under it. It's available to
+// layout.html templates as .TOC
+type tocEntry struct {
+	Level    int
+	ID       string
+	Title    string
+	Children []*tocEntry
+}
+
+// collectHeadings() walks the syntax tree for a Markdown document
+// and returns its headings. Goldmark has already given each one
+// an id through parser.WithAutoHeadingID().
+func collectHeadings(document ast.Node, source []byte) []heading {
+	headings := []heading{}
+	ast.Walk(document, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		h, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		id := ""
+		if v, ok := h.AttributeString("id"); ok {
+			if b, ok := v.([]byte); ok {
+				id = string(b)
+			}
+		}
+		headings = append(headings, heading{
+			level: h.Level,
+			id:    id,
+			title: string(h.Text(source)),
+		})
+		return ast.WalkSkipChildren, nil
+	})
+	return headings
+}
+
+// tocLevels() returns the smallest and largest heading
+// levels to include in the table of contents, set like this in
+// the page's front matter, or sitewide on the home page:
+// ---
+// tocmin: 2
+// tocmax: 3
+// ---
+// Defaults to h2 through h3.
+func (c *config) tocLevels() (int, int) {
+	level := func(key string, def int) int {
+		if n := fmInt(key, c.pageFm); n > 0 {
+			return n
+		}
+		if n := fmInt(key, c.globalFm); n > 0 {
+			return n
+		}
+		return def
+	}
+	return level("tocmin", 2), level("tocmax", 3)
+}
+
+// tocTree() nests the headings of the current page
+// between the minimum and maximum levels.
+func (c *config) tocTree() []*tocEntry {
+	min, max := c.tocLevels()
+	root := &tocEntry{}
+	// Stack of open entries. The root sits below every level.
+	stack := []*tocEntry{root}
+	for _, h := range c.headings {
+		if h.level < min || h.level > max {
+			continue
+		}
+		entry := &tocEntry{Level: h.level, ID: h.id, Title: h.title}
+		for len(stack) > 1 && stack[len(stack)-1].Level >= h.level {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, entry)
+		stack = append(stack, entry)
+	}
+	return root.Children
+}
+
+// tocListHTML() renders entries as nested unordered lists.
+func tocListHTML(entries []*tocEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	s := "<ul>\n"
+	for _, e := range entries {
+		s += "<li><a href=\"#" + template.HTMLEscapeString(e.ID) + "\">" +
+			template.HTMLEscapeString(e.Title) + "</a>" +
+			tocListHTML(e.Children) + "</li>\n"
+	}
+	return s + "</ul>\n"
+}
+
+// tocHTML() returns the table of contents for the current page.
+// It's available to templates as toc.
+func (c *config) tocHTML() template.HTML {
+	list := tocListHTML(c.tocTree())
+	if list == "" {
+		return ""
+	}
+	return template.HTML("<div class=\"toc-poco\">\n" + list + "</div>\n")
+}
+
+// insertTOC() adds the table of contents to a page
+// with this in its front matter:
+// ---
+// toc: true
+// ---
+// It replaces a [TOC] line in the article if there is one.
+// Otherwise the table of contents goes at the top of the article.
+func (c *config) insertTOC(article string) string {
+	if !fmBool("toc", c.pageFm) {
+		return article
+	}
+	toc := string(c.tocHTML())
+	if strings.Contains(article, tocMarker) {
+		return strings.Replace(article, tocMarker, toc, 1)
+	}
+	return toc + article
+}
+
+// IMAGE UTILITIES
+
+// Name of directory under .poco holding files kept
+// between builds, such as resized images
+const cacheDir = "cache"
+
+// Name of directory under the cache holding resized images
+const imageCacheDir = "images"
+
+// imgTagRe matches an HTML img tag.
+var imgTagRe = regexp.MustCompile(`<img\s[^>]*>`)
+
+// imageOptions controls responsive images. See imageSettings().
+type imageOptions struct {
+	// Widths in pixels of the resized variants to generate
+	widths []int
+	// Value of the sizes attribute
+	sizes string
+	// JPEG quality from 1 to 100
+	quality int
+	// Add loading="lazy" to images
+	lazy bool
+}
+
+// imageVariant is a resized copy of an image to publish.
+type imageVariant struct {
+	// Full pathname of the original image
+	source string
+	// Width in pixels of the copy
+	width int
+	// JPEG quality from 1 to 100
+	quality int
+}
+
+// imageSettings() returns the responsive image settings from
+// the home page's front matter. Responsive images are off
+// unless images: is present, either as images: true to use
+// the defaults or with settings:
+//
+//	---
+//	images:
+//	  widths: [480, 960, 1600]
+//	  sizes: "(max-width: 768px) 100vw, 80vw"
+//	  quality: 80
+//	  lazy: true
+//	---
+//
+// A page can opt out with images: false.
+func (c *config) imageSettings() (imageOptions, bool) {
+	opts := imageOptions{
+		widths:  []int{480, 960, 1600},
+		sizes:   "(max-width: 768px) 100vw, 80vw",
+		quality: 80,
+		lazy:    true,
+	}
+	if on, ok := c.pageFm["images"].(bool); ok && !on {
+		return opts, false
+	}
+	v, ok := c.globalFm["images"]
+	if !ok {
+		return opts, false
+	}
+	settings, isMap := v.(map[interface{}]interface{})
+	if !isMap {
+		return opts, fmBool("images", c.globalFm)
+	}
+	fm := map[string]interface{}{}
+	for k, value := range settings {
+		fm[strings.ToLower(fmt.Sprintf("%v", k))] = value
+	}
+	if widths, ok := fm["widths"].([]interface{}); ok {
+		opts.widths = []int{}
+		for _, w := range widths {
+			if n, err := strconv.Atoi(fmt.Sprint(w)); err == nil && n > 0 {
+				opts.widths = append(opts.widths, n)
+			}
+		}
+	}
+	sort.Ints(opts.widths)
+	if sizes := fmStr("sizes", fm); sizes != "" {
+		opts.sizes = sizes
+	}
+	if q := fmInt("quality", fm); q > 0 && q <= 100 {
+		opts.quality = q
+	}
+	if _, ok := fm["lazy"]; ok {
+		opts.lazy = fmBool("lazy", fm)
+	}
+	return opts, true
+}
+
+// htmlAttr() returns the value of the named attribute in an
+// HTML tag, and whether the attribute is present.
+func htmlAttr(tag, name string) (string, bool) {
+	z := xhtml.NewTokenizer(strings.NewReader(tag))
+	if tt := z.Next(); tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+		return "", false
+	}
+	for _, a := range z.Token().Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// processImages() rewrites the img tags in article for local
+// JPEG and PNG images, if responsive images are on. Each gets
+// width and height attributes, loading="lazy", and, if it's
+// wider than any of the widths in imageSettings(), a srcset
+// listing resized copies. The copies are written at the end
+// of the build by writeImageVariants().
+func (c *config) processImages(article string) string {
+	opts, ok := c.imageSettings()
+	if !ok {
+		return article
+	}
+	return imgTagRe.ReplaceAllStringFunc(article, func(tag string) string {
+		return c.processImage(tag, opts)
+	})
+}
+
+// processImage() rewrites a single img tag for processImages().
+func (c *config) processImage(tag string, opts imageOptions) string {
+	src, _ := htmlAttr(tag, "src")
+	if _, ok := htmlAttr(tag, "srcset"); ok || src == "" ||
+		strings.Contains(src, ":") || strings.HasPrefix(src, "//") {
+		return tag
+	}
+	ext := path.Ext(src)
+	if e := strings.ToLower(ext); e != ".jpg" && e != ".jpeg" && e != ".png" {
+		return tag
+	}
+	name, err := url.PathUnescape(src)
+	if err != nil {
+		return tag
+	}
+	var source string
+	if strings.HasPrefix(name, "/") {
+		source = filepath.Join(c.root, filepath.FromSlash(name))
+	} else {
+		source = filepath.Join(filepath.Dir(c.currentFilename), filepath.FromSlash(name))
+	}
+	rel, err := filepath.Rel(c.root, source)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return tag
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		warn("%s: can't find image %s", c.relToRoot(c.currentFilename), src)
+		return tag
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		warn("%s: can't read image %s: %v", c.relToRoot(c.currentFilename), src, err)
+		return tag
+	}
+
+	attrs := ""
+	if _, ok := htmlAttr(tag, "width"); !ok {
+		attrs += fmt.Sprintf(` width="%d" height="%d"`, config.Width, config.Height)
+	}
+	if _, ok := htmlAttr(tag, "loading"); !ok && opts.lazy {
+		attrs += ` loading="lazy" decoding="async"`
+	}
+	srcset := []string{}
+	for _, width := range opts.widths {
+		if width >= config.Width {
+			break
+		}
+		suffix := fmt.Sprintf("-%dw", width)
+		target := filepath.Join(c.webroot, strings.TrimSuffix(rel, ext)+suffix+ext)
+		c.imageVariants[target] = imageVariant{source: source, width: width, quality: opts.quality}
+		srcset = append(srcset, fmt.Sprintf("%s %dw", strings.TrimSuffix(src, ext)+suffix+ext, width))
+	}
+	if len(srcset) > 0 {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", src, config.Width))
+		attrs += ` srcset="` + htmlstd.EscapeString(strings.Join(srcset, ", ")) +
+			`" sizes="` + htmlstd.EscapeString(opts.sizes) + `"`
+	}
+	// Goldmark writes XHTML-style <img ... />
+	body, end := strings.TrimSuffix(tag, ">"), ">"
+	if strings.HasSuffix(body, "/") {
+		body, end = strings.TrimRight(strings.TrimSuffix(body, "/"), " "), " />"
+	}
+	return body + attrs + end
+}
+
+// writeImageVariants() publishes the resized images
+// requested by processImages(). Each is cached in
+// .poco/cache/images under a hash of the original,
+// so it's only resized again if the original changes.
+// Cached images this build didn't use are deleted,
+// so the cache doesn't grow as images change.
+func (c *config) writeImageVariants() {
+	targets := make([]string, 0, len(c.imageVariants))
+	for target := range c.imageVariants {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	dir := filepath.Join(c.root, pocoDir, cacheDir, imageCacheDir)
+	resized := 0
+	used := map[string]bool{}
+	for _, target := range targets {
+		v := c.imageVariants[target]
+		b, err := os.ReadFile(v.source)
+		if err != nil {
+			quit(1, err, c, "Unable to read image %s", v.source)
+		}
+		ext := strings.ToLower(filepath.Ext(v.source))
+		cached := filepath.Join(dir, fmt.Sprintf("%s-%dw-q%d%s", hashBytes(b)[:16], v.width, v.quality, ext))
+		used[filepath.Base(cached)] = true
+		if !fileExists(cached) {
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+				quit(1, err, c, "Unable to create image cache directory %s", dir)
+			}
+			if err := resizeImage(b, cached, v.width, v.quality); err != nil {
+				quit(1, err, c, "Unable to resize image %s", v.source)
+			}
+			resized++
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			quit(1, err, c, "Unable to create directory %s", filepath.Dir(target))
+		}
+		copyFile(c, cached, target)
+	}
+	if len(targets) > 0 {
+		c.verbose("%d resized images, %d from cache", len(targets), len(targets)-resized)
+	}
+	c.pruneImageCache(dir, used)
+}
+
+// pruneImageCache() deletes the files in the image cache
+// directory dir whose names aren't in used.
+func (c *config) pruneImageCache(dir string, used map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	pruned := 0
+	for _, entry := range entries {
+		if entry.IsDir() || used[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			warn("Unable to delete cached image %s: %v", entry.Name(), err)
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		c.verbose("%d unused images deleted from cache", pruned)
+	}
+}
+
+// resizeImage() scales the JPEG or PNG image in b to the given
+// width, keeping its aspect ratio, and writes it to filename
+// in the same format.
+func resizeImage(b []byte, filename string, width, quality int) error {
+	src, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	bounds := src.Bounds()
+	height := (bounds.Dy()*width + bounds.Dx()/2) / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	var buf bytes.Buffer
+	if format == "png" {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// MINIFY UTILITIES
+
+// minifier strips comments and unneeded whitespace from HTML,
+// including inline <style> blocks and scripts, and from
+// stylesheets and Javascript copied to the webroot.
+var minifier = newMinifier()
+
+// newMinifier() returns a minifier for HTML, CSS, and Javascript.
+// Document and end tags are kept so themes and scripts that
+// look for them still work.
+func newMinifier() *minify.M {
+	m := minify.New()
+	m.Add("text/html", &minhtml.Minifier{
+		KeepDocumentTags: true,
+		KeepEndTags:      true,
+	})
+	m.AddFunc("text/css", mincss.Minify)
+	m.AddFuncRegexp(regexp.MustCompile(`^(application|text)/(x-)?(java|ecma)script$`), minjs.Minify)
+	return m
+}
+
+// minifyTypes maps the extensions of assets minified
+// by -minify to their media types.
+var minifyTypes = map[string]string{
+	".css": "text/css",
+	".js":  "application/javascript",
+}
+
+// minifyStats totals the sizes of files minified by -minify.
+type minifyStats struct {
+	// Number of files minified
+	files int
+	// Total size in bytes before minification
+	before int
+	// Total size in bytes after minification
+	after int
+}
+
+// minifyString() returns s minified as the media type
+// mediaType if -minify was used, and s unchanged otherwise.
+// filename is only used for messages.
+// If s can't be minified, it's returned unchanged
+// with a warning.
+func (c *config) minifyString(mediaType string, filename string, s string) string {
+	if !c.minifyFlag || s == "" {
+		return s
+	}
+	minified, err := minifier.String(mediaType, s)
+	if err != nil {
+		warn("Unable to minify %s: %v", filename, err)
+		return s
+	}
+	c.minified.files++
+	c.minified.before += len(s)
+	c.minified.after += len(minified)
+	return minified
+}
+
+// minifyFile() copies the stylesheet or Javascript file
+// source to target, minifying it on the way.
+// Returns false if source isn't a type that gets minified.
+func (c *config) minifyFile(source string, target string) bool {
+	mediaType, ok := minifyTypes[strings.ToLower(filepath.Ext(source))]
+	if !ok {
+		return false
+	}
+	stringToFile(c, target, c.minifyString(mediaType, source, c.fileToString(source)))
+	return true
+}
+
+// minifyReport() describes how much -minify saved, for example:
+//
+//	Minified 12 files from 184.2 KB to 61.7 KB (66% smaller)
+func (c *config) minifyReport() string {
+	s := c.minified
+	if s.files == 0 {
+		return ""
+	}
+	saved := 0
+	if s.before > 0 {
+		saved = (s.before - s.after) * 100 / s.before
+	}
+	files := "files"
+	if s.files == 1 {
+		files = "file"
+	}
+	return fmt.Sprintf("Minified %d %s from %.1f KB to %.1f KB (%d%% smaller)",
+		s.files, files, float64(s.before)/1024, float64(s.after)/1024, saved)
+}
+
+// REMOTE FILE SECURITY
+
+// Name of the file in .poco pinning the hashes of remote files
+const integrityLock = "integrity.json"
+
+// integrityTagRe matches link and script tags
+var integrityTagRe = regexp.MustCompile(`(?i)<(link|script)\b[^>]*>`)
+
+// allowedHost() returns an error unless the host of rawURL is
+// named in the home page's front matter, if it has a list:
+//
+//	---
+//	remotehosts:
+//	- fonts.googleapis.com
+//	- "*.jsdelivr.net"
+//	---
+//
+// Without remotehosts: any host is allowed.
+func (c *config) allowedHost(rawURL string) error {
+	hosts := fmStrSlice("remotehosts", c.globalFm)
+	if len(hosts) == 0 {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed ||
+			(strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't listed in remotehosts: on the home page", host)
+}
+
+// sri() returns the Subresource Integrity hash of b using
+// the named algorithm, sha256, sha384, or sha512: the
+// algorithm, a hyphen, and the base64-encoded hash.
+func sri(algorithm string, b []byte) string {
+	var sum []byte
+	switch algorithm {
+	case "sha256":
+		s := sha256.Sum256(b)
+		sum = s[:]
+	case "sha512":
+		s := sha512.Sum512(b)
+		sum = s[:]
+	default:
+		algorithm = "sha384"
+		s := sha512.Sum384(b)
+		sum = s[:]
+	}
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// pinnedHashes() returns the expected hashes of remote files,
+// keyed by URL. They come from .poco/integrity.json, which
+// -lock creates, and from the home page's front matter,
+// which takes priority:
+//
+//	---
+//	integrity:
+//	  "https://cdn.example.com/style.css": "sha384-oqVuAfXRKap7..."
+//	---
+func (c *config) pinnedHashes() map[string]string {
+	pins := map[string]string{}
+	if !c.lockFlag {
+		if b, err := os.ReadFile(filepath.Join(c.root, pocoDir, integrityLock)); err == nil {
+			if err := json.Unmarshal(b, &pins); err != nil {
+				quit(1, err, c, "Unable to read %s", integrityLock)
+			}
+		}
+	}
+	// Not fmMap(), because URLs are case sensitive
+	if m, ok := c.globalFm["integrity"].(map[interface{}]interface{}); ok {
+		for k, v := range m {
+			pins[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+	}
+	return pins
+}
+
+// checkIntegrity() returns an error if b, the contents of url,
+// don't match the hash pinned for it. It also records
+// the hash for -lock.
+func (c *config) checkIntegrity(url string, b []byte) error {
+	c.integrity[url] = sri("sha384", b)
+	if c.pins == nil {
+		c.pins = c.pinnedHashes()
+	}
+	expected, ok := c.pins[url]
+	if !ok {
+		return nil
+	}
+	algorithm, _, _ := strings.Cut(expected, "-")
+	if actual := sri(algorithm, b); actual != expected {
+		return fmt.Errorf("expected hash %s but got %s", expected, actual)
+	}
+	return nil
+}
+
+// addIntegrity() adds integrity and crossorigin attributes to
+// link rel="stylesheet" and script tags in tags that refer
+// to remote files, so browsers refuse files that have
+// changed since the site was built.
+func (c *config) addIntegrity(tags string) string {
+	return integrityTagRe.ReplaceAllStringFunc(tags, func(tag string) string {
+		attr := "src"
+		if strings.EqualFold(tag[1:5], "link") {
+			if rel, _ := htmlAttr(tag, "rel"); !strings.EqualFold(rel, "stylesheet") {
+				return tag
+			}
+			attr = "href"
+		}
+		address, _ := htmlAttr(tag, attr)
+		if _, ok := htmlAttr(tag, "integrity"); ok || !strings.HasPrefix(address, "http") {
+			return tag
+		}
+		if _, err := c.fetch(address); err != nil {
+			quit(1, err, c, "Unable to download file %s", address)
+		}
+		end := strings.TrimSuffix(strings.TrimSuffix(tag, ">"), "/")
+		end = strings.TrimRight(end, " ")
+		return end + fmt.Sprintf(` integrity="%s" crossorigin="anonymous"`, c.integrity[address]) + tag[len(end):]
+	})
+}
+
+// writeIntegrityLock() saves the hash of every remote file
+// used in this build to .poco/integrity.json when -lock
+// is used. Later builds fail if any of those files change.
+func (c *config) writeIntegrityLock() {
+	if !c.lockFlag {
+		return
+	}
+	b, err := json.MarshalIndent(c.integrity, "", "  ")
+	if err != nil {
+		quit(1, err, c, "Unable to create %s", integrityLock)
+	}
+	stringToFile(c, filepath.Join(c.root, pocoDir, integrityLock), string(b)+"\n")
+	c.verbose("%d remote file hashes saved to %s", len(c.integrity), integrityLock)
+}
+
+// CONTENT SECURITY POLICY
+
+// Name of the file in the webroot giving the
+// Content-Security-Policy header for each page,
+// in the format used by Netlify and Cloudflare Pages
+const cspHeadersFile = "_headers"
+
+// cspDirectives lists the directives of the generated policy, in order
+var cspDirectives = []string{"default-src", "script-src", "style-src", "img-src", "frame-src", "object-src", "base-uri"}
+
+// inlineScriptRe matches a script element, capturing its
+// attributes and contents
+var inlineScriptRe = regexp.MustCompile(`(?is)<script\b([^>]*)>(.*?)</script>`)
+
+// inlineStyleRe matches a style element, capturing its contents
+var inlineStyleRe = regexp.MustCompile(`(?is)<style\b[^>]*>(.*?)</style>`)
+
+// startTagRe matches an HTML start tag, capturing its name
+var startTagRe = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)\b[^>]*>`)
+
+// tagAttrRe matches an attribute with a value, quoted or not,
+// such as src="foo.js" or style=color:red
+var tagAttrRe = regexp.MustCompile(`\s([a-zA-Z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// importRe matches a dynamic import of a remote script,
+// as in import('https://cdn.jsdelivr.net/npm/mermaid.mjs')
+var importRe = regexp.MustCompile(`import\(\s*['"](https?://[^'"]+)['"]`)
+
+// headRe matches the head start tag
+var headRe = regexp.MustCompile(`(?i)<head\b[^>]*>`)
+
+// tagAttrs() returns the attributes with values in
+// an HTML tag, keyed by lowercase name.
+func tagAttrs(tag string) map[string]string {
+	attrs := map[string]string{}
+	for _, a := range tagAttrRe.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(a[1])] = htmlstd.UnescapeString(a[2] + a[3] + a[4])
+	}
+	return attrs
+}
+
+// cspMeta() reports whether -csp adds a meta tag to pages.
+func (c *config) cspMeta() bool {
+	return c.csp == "meta" || c.csp == "both"
+}
+
+// cspHeaders() reports whether -csp writes a _headers file.
+func (c *config) cspHeaders() bool {
+	return c.csp == "headers" || c.csp == "both"
+}
+
+// origin() returns the scheme and host of a remote URL,
+// such as https://cdn.jsdelivr.net, or "" for local URLs.
+func origin(address string) string {
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// contentSecurityPolicy() returns a Content-Security-Policy for
+// the finished page in html that allows only the inline scripts
+// and styles it contains, by their SHA-256 hashes, plus files
+// from the site itself and the remote hosts it links to.
+// Sources can be added in the home page's front matter:
+//
+//	---
+//	csp:
+//	  img-src: "https://images.example.com"
+//	  connect-src: "'self' https://api.example.com"
+//	---
+func (c *config) contentSecurityPolicy(html string) string {
+	sources := map[string][]string{
+		"default-src": {"'self'"},
+		"script-src":  {"'self'"},
+		"style-src":   {"'self'"},
+		"img-src":     {"'self'", "data:"},
+		"object-src":  {"'none'"},
+		"base-uri":    {"'self'"},
+	}
+	add := func(directive string, source string) {
+		if source != "" && !slices.Contains(sources[directive], source) {
+			sources[directive] = append(sources[directive], source)
+		}
+	}
+	for _, m := range inlineScriptRe.FindAllStringSubmatch(html, -1) {
+		if _, ok := tagAttrs(m[1])["src"]; ok {
+			continue
+		}
+		add("script-src", "'"+sri("sha256", []byte(m[2]))+"'")
+		for _, imp := range importRe.FindAllStringSubmatch(m[2], -1) {
+			add("script-src", origin(imp[1]))
+		}
+	}
+	for _, m := range inlineStyleRe.FindAllStringSubmatch(html, -1) {
+		add("style-src", "'"+sri("sha256", []byte(m[1]))+"'")
+	}
+	for _, tag := range startTagRe.FindAllStringSubmatch(html, -1) {
+		attrs := tagAttrs(tag[0])
+		switch strings.ToLower(tag[1]) {
+		case "script":
+			add("script-src", origin(attrs["src"]))
+		case "link":
+			if strings.EqualFold(attrs["rel"], "stylesheet") {
+				add("style-src", origin(attrs["href"]))
+			}
+		case "img", "source":
+			add("img-src", origin(attrs["src"]))
+		case "iframe":
+			add("frame-src", origin(attrs["src"]))
+		}
+		// Style attributes can only be allowed by hash
+		// along with 'unsafe-hashes'.
+		if style, ok := attrs["style"]; ok {
+			add("style-src", "'unsafe-hashes'")
+			add("style-src", "'"+sri("sha256", []byte(style))+"'")
+		}
+	}
+	directives := append([]string{}, cspDirectives...)
+	extra := fmMap("csp", c.globalFm)
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(directives, name) {
+			directives = append(directives, name)
+		}
+		for _, source := range strings.Fields(extra[name]) {
+			add(name, source)
+		}
+	}
+	policy := []string{}
+	for _, name := range directives {
+		if len(sources[name]) > 0 {
+			policy = append(policy, name+" "+strings.Join(sources[name], " "))
+		}
+	}
+	return strings.Join(policy, "; ")
+}
+
+// addCSP() adds a Content-Security-Policy meta tag to the
+// start of the head of the finished page in html, and saves
+// the policy for the _headers file, depending on -csp.
+// It has to run on the page exactly as published, because
+// any change to an inline script or style invalidates its hash.
+func (c *config) addCSP(html string) string {
+	if c.csp == "" {
+		return html
+	}
+	policy := c.contentSecurityPolicy(html)
+	if c.cspHeaders() {
+		c.cspPolicies[c.currentURL()] = policy
+	}
+	if !c.cspMeta() {
+		return html
+	}
+	meta := fmt.Sprintf(`<meta http-equiv="Content-Security-Policy" content="%s">`, htmlstd.EscapeString(policy))
+	if loc := headRe.FindStringIndex(html); loc != nil {
+		return html[:loc[1]] + meta + html[loc[1]:]
+	}
+	warn("%s: no <head> tag for the Content-Security-Policy", c.relToRoot(c.currentFilename))
+	return html
+}
+
+// writeCSPHeaders() publishes the policy for every
+// page to the _headers file in the webroot, if -csp
+// calls for it.
+func (c *config) writeCSPHeaders() {
+	if !c.cspHeaders() || len(c.cspPolicies) == 0 {
+		return
+	}
+	urls := make([]string, 0, len(c.cspPolicies))
+	for u := range c.cspPolicies {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	headers := ""
+	for _, u := range urls {
+		headers += u + "\n  Content-Security-Policy: " + c.cspPolicies[u] + "\n"
+	}
+	stringToFile(c, filepath.Join(c.webroot, cspHeadersFile), headers)
+}
+
+// SAFE HTML
+
+// Tags allowed by safehtml: sanitize unless the
+// home page's front matter adds more
+var safeTags = []string{"a", "abbr", "address", "article", "aside", "b", "bdi", "bdo",
+	"blockquote", "br", "caption", "cite", "code", "col", "colgroup", "dd", "del",
+	"details", "dfn", "div", "dl", "dt", "em", "figcaption", "figure", "footer",
+	"h1", "h2", "h3", "h4", "h5", "h6", "header", "hr", "i", "img", "ins", "kbd",
+	"li", "main", "mark", "nav", "ol", "p", "pre", "q", "rp", "rt", "ruby", "s",
+	"samp", "section", "small", "span", "strong", "sub", "summary", "sup", "table",
+	"tbody", "td", "tfoot", "th", "thead", "time", "tr", "u", "ul", "var", "wbr"}
+
+// Attributes allowed by safehtml: sanitize unless the
+// home page's front matter adds more
+var safeAttributes = []string{"abbr", "align", "alt", "cite", "class", "colspan",
+	"datetime", "dir", "headers", "height", "href", "id", "lang", "open",
+	"reversed", "rowspan", "scope", "span", "src", "start", "title", "value", "width"}
+
+// URL schemes allowed by safehtml: sanitize unless the
+// home page's front matter adds more. URLs without a scheme
+// are always allowed.
+var safeSchemes = []string{"http", "https", "mailto"}
+
+// Attributes holding URLs, which are checked for allowed schemes
+var urlAttributes = []string{"action", "background", "cite", "formaction", "href", "longdesc", "poster", "src"}
+
+// Elements whose contents are removed along with them,
+// instead of being left behind as text
+var rawTextTags = []string{"iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "textarea", "title", "xmp"}
+
+// htmlSanitizer removes HTML not on its allowlist
+// from pages. See safeHTML().
+type htmlSanitizer struct {
+	// Remove all raw HTML from Markdown instead of sanitizing it
+	strip bool
+	// Allowed tags, attributes, and URL schemes
+	tags       []string
+	attributes []string
+	schemes    []string
+	// Everything removed so far, for reporting
+	violations []string
+}
+
+// safeHTML() returns a sanitizer for the current page,
+// or nil if raw HTML is allowed. It's controlled by
+// safehtml: in the front matter. It can be strip, which
+// removes all raw HTML from Markdown, or sanitize, which
+// removes only tags, attributes, and URLs not on an allowlist:
+//
+//	---
+//	safehtml: sanitize
+//	---
+//
+// The home page can add to the allowlist:
+//
+//	---
+//	safehtml:
+//	  mode: sanitize
+//	  tags: [iframe]
+//	  attributes: [allowfullscreen]
+//	  schemes: [tel]
+//	---
+//
+// HTML files used for headers, footers, regions, and the
+// like are sanitized in either mode, and so are links and
+// images in Markdown. A theme's layout.html is the page's
+// document template, not content, so it's left alone.
+// Shortcodes that produce HTML are treated like raw HTML,
+// because they're expanded first.
+// A page can make its own setting stricter, but not looser,
+// so contributed pages can't turn it off.
+func (c *config) safeHTML() *htmlSanitizer {
+	modes := []string{"", "sanitize", "strip"}
+	mode := func(fm map[string]interface{}) int {
+		m := fmStr("safehtml", fm)
+		if settings := fmMap("safehtml", fm); len(settings) > 0 {
+			m = settings["mode"]
+		}
+		i := slices.Index(modes, strings.ToLower(m))
+		if i < 0 {
+			i = 0
+		}
+		return i
+	}
+	m := mode(c.globalFm)
+	if p := mode(c.pageFm); p > m {
+		m = p
+	}
+	if m == 0 {
+		return nil
+	}
+	s := &htmlSanitizer{
+		strip:      modes[m] == "strip",
+		tags:       append([]string{}, safeTags...),
+		attributes: append([]string{}, safeAttributes...),
+		schemes:    append([]string{}, safeSchemes...),
+	}
+	if settings, ok := c.globalFm["safehtml"].(map[interface{}]interface{}); ok {
+		fm := map[string]interface{}{}
+		for k, v := range settings {
+			fm[strings.ToLower(fmt.Sprint(k))] = v
+		}
+		for _, tag := range fmStrSlice("tags", fm) {
+			s.tags = append(s.tags, strings.ToLower(tag))
+		}
+		for _, attr := range fmStrSlice("attributes", fm) {
+			s.attributes = append(s.attributes, strings.ToLower(attr))
+		}
+		for _, scheme := range fmStrSlice("schemes", fm) {
+			s.schemes = append(s.schemes, strings.ToLower(scheme))
+		}
+	}
+	return s
+}
+
+// report() records something removed by the sanitizer.
+func (s *htmlSanitizer) report(format string, ss ...interface{}) {
+	s.violations = append(s.violations, fmt.Sprintf(format, ss...))
+}
+
+// reportViolations() warns about everything the sanitizer
+// removed from filename, one line each.
+func (c *config) reportViolations(filename string, s *htmlSanitizer) {
+	if s == nil {
+		return
+	}
+	for _, v := range s.violations {
+		warn("%s: %s", c.relToRoot(filename), v)
+	}
+	s.violations = nil
+}
+
+// allowedURL() reports whether the URL in an attribute
+// is relative or uses an allowed scheme.
+func (s *htmlSanitizer) allowedURL(address string) bool {
+	// Browsers ignore whitespace and control
+	// characters, as in java&#9;script:
+	address = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, address)
+	colon := strings.Index(address, ":")
+	if colon < 0 || strings.ContainsAny(address[:colon], "/?#") {
+		return true
+	}
+	return slices.Contains(s.schemes, strings.ToLower(address[:colon]))
+}
+
+// startTag() returns tok as a start tag with only its allowed attributes.
+func (s *htmlSanitizer) startTag(tok xhtml.Token, selfClosing bool) string {
+	tag := "<" + tok.Data
+	for _, a := range tok.Attr {
+		switch {
+		case !slices.Contains(s.attributes, a.Key) || strings.HasPrefix(a.Key, "on"):
+			s.report("removed %s attribute from <%s>", a.Key, tok.Data)
+		case slices.Contains(urlAttributes, a.Key) && !s.allowedURL(a.Val):
+			s.report("removed %s=%q from <%s>", a.Key, a.Val, tok.Data)
+		default:
+			tag += fmt.Sprintf(` %s="%s"`, a.Key, xhtml.EscapeString(a.Val))
+		}
+	}
+	if selfClosing {
+		tag += " /"
+	}
+	return tag + ">"
+}
+
+// sanitize() returns the HTML in fragment with every tag,
+// attribute, and URL not on the allowlist removed.
+// Text is kept, except inside removed elements such as
+// script. Comments are removed too.
+func (s *htmlSanitizer) sanitize(fragment string) string {
+	var out strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(fragment))
+	// Name of removed element whose contents are being skipped
+	skip := ""
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			return out.String()
+		}
+		// Raw() has to be copied before Token() lowercases the tag name
+		raw := string(z.Raw())
+		tok := z.Token()
+		if skip != "" {
+			if tt == xhtml.EndTagToken && tok.Data == skip {
+				skip = ""
+			}
+			continue
+		}
+		switch tt {
+		case xhtml.TextToken:
+			out.WriteString(raw)
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if !slices.Contains(s.tags, tok.Data) {
+				s.report("removed <%s> tag", tok.Data)
+				if tt == xhtml.StartTagToken && slices.Contains(rawTextTags, tok.Data) {
+					skip = tok.Data
+				}
+				continue
+			}
+			out.WriteString(s.startTag(tok, tt == xhtml.SelfClosingTagToken))
+		case xhtml.EndTagToken:
+			if slices.Contains(s.tags, tok.Data) {
+				out.WriteString("</" + tok.Data + ">")
+			}
+		case xhtml.CommentToken:
+			s.report("removed comment")
+		case xhtml.DoctypeToken:
+			s.report("removed doctype")
+		}
+	}
+}
+
+// rawHTML() returns raw HTML from Markdown, sanitized
+// or, in strip mode, removed.
+func (s *htmlSanitizer) rawHTML(raw string) string {
+	if !s.strip {
+		return s.sanitize(raw)
+	}
+	snippet := strings.Join(strings.Fields(raw), " ")
+	if len(snippet) > 40 {
+		snippet = snippet[:40] + "..."
+	}
+	s.report("removed raw HTML %s", snippet)
+	return ""
+}
+
+// safeHTMLRenderer renders raw HTML in Markdown
+// through an htmlSanitizer.
+type safeHTMLRenderer struct {
+	s *htmlSanitizer
+}
+
+// RegisterFuncs() replaces Goldmark's raw HTML renderers.
+func (r *safeHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+}
+
+// renderHTMLBlock() writes a block of raw HTML, such as
+// a <div> on its own line, after sanitizing it.
+func (r *safeHTMLRenderer) renderHTMLBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.HTMLBlock)
+	var b bytes.Buffer
+	for i := 0; i < n.Lines().Len(); i++ {
+		line := n.Lines().At(i)
+		b.Write(line.Value(source))
+	}
+	if n.HasClosure() {
+		b.Write(n.ClosureLine.Value(source))
+	}
+	w.WriteString(r.s.rawHTML(b.String()))
+	return ast.WalkContinue, nil
+}
+
+// renderRawHTML() writes an inline HTML tag, such
+// as <span class="x">, after sanitizing it.
+func (r *safeHTMLRenderer) renderRawHTML(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	n := node.(*ast.RawHTML)
+	var b bytes.Buffer
+	for i := 0; i < n.Segments.Len(); i++ {
+		segment := n.Segments.At(i)
+		b.Write(segment.Value(source))
+	}
+	w.WriteString(r.s.rawHTML(b.String()))
+	return ast.WalkSkipChildren, nil
+}
+
+// safeURLTransformer removes Markdown links and images
+// whose URLs use schemes not allowed by an htmlSanitizer,
+// such as [x](javascript:alert(1)). Links and images
+// keep their text, and autolinks become plain text.
+type safeURLTransformer struct {
+	s *htmlSanitizer
+}
+
+// Transform implements parser.ASTTransformer.Transform
+func (t *safeURLTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var nodes []ast.Node
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			if !t.s.allowedURL(string(n.Destination)) {
+				t.s.report("removed link to %q", n.Destination)
+				nodes = append(nodes, n)
+			}
+		case *ast.Image:
+			if !t.s.allowedURL(string(n.Destination)) {
+				t.s.report("removed image %q", n.Destination)
+				nodes = append(nodes, n)
+			}
+		case *ast.AutoLink:
+			if !t.s.allowedURL(string(n.URL(source))) {
+				t.s.report("removed link to %q", n.URL(source))
+				nodes = append(nodes, n)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, n := range nodes {
+		parent := n.Parent()
+		if autolink, ok := n.(*ast.AutoLink); ok {
+			parent.ReplaceChild(parent, n, ast.NewString(autolink.Label(source)))
+			continue
+		}
+		for child := n.FirstChild(); child != nil; child = n.FirstChild() {
+			parent.InsertBefore(parent, n, child)
+		}
+		parent.RemoveChild(parent, n)
+	}
+}
+
+// safeHTMLExtension runs raw HTML in Markdown through an
+// htmlSanitizer, and checks the URLs of links and images.
+type safeHTMLExtension struct {
+	s *htmlSanitizer
+}
+
+// Extend() adds the sanitizing renderer to Goldmark.
+func (e *safeHTMLExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(
+		util.Prioritized(&safeURLTransformer{s: e.s}, 100),
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		// Takes priority over Goldmark's own HTML renderer
+		util.Prioritized(&safeHTMLRenderer{s: e.s}, 100),
+	))
+}
+
+// SEARCH UTILITIES
+
+// Name of the search index published in the webroot
+const searchIndexFilename = "search-index.json"
+
+// Name of the search results page source file. If the project
+// doesn't have one, the one in .poco/search is used.
+const searchPageFilename = "search.md"
+
+// Name of directory under .poco holding the
+// default search results page
+const searchDir = "search"
+
+// searchEntry is one page in the search index.
+type searchEntry struct {
+	Title    string   `json:"title"`
+	URL      string   `json:"url"`
+	Headings []string `json:"headings,omitempty"`
+	Text     string   `json:"text"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// htmlTagRe matches HTML tags, and script and style
+// elements along with their contents.
+var htmlTagRe = regexp.MustCompile(`(?is)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+
+// stripHTML() returns the text of an HTML fragment
+// with tags removed and whitespace collapsed.
+func stripHTML(s string) string {
+	s = htmlTagRe.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(htmlstd.UnescapeString(s)), " ")
+}
+
+// searchEnabled() returns true if the home page
+// turns on site search:
+// ---
+// search: true
+// ---
+func (c *config) searchEnabled() bool {
+	return fmBool("search", c.globalFm)
+}
+
+// addToSearchIndex() adds the page just built to the search
+// index, unless search is off or the page opts out with
+// search: false in its front matter.
+func (c *config) addToSearchIndex() {
+	if !c.searchEnabled() {
+		return
+	}
+	if _, ok := c.pageFm["search"]; ok && !fmBool("search", c.pageFm) {
+		return
+	}
+	if c.currentIsNotFoundPage() {
+		return
+	}
+	rel, err := filepath.Rel(c.root, c.currentFilename)
+	if err != nil {
+		return
+	}
+	entry := searchEntry{
+		Title: htmlstd.UnescapeString(fmStr("title", c.pageFm)),
+		URL:   pageURL(rel),
+		Text:  stripHTML(c.articleParsed),
+		Tags:  fmStrSlice("tags", c.pageFm),
+	}
+	for _, h := range c.headings {
+		if h.level == 1 && entry.Title == "" {
+			entry.Title = h.title
+			continue
+		}
+		entry.Headings = append(entry.Headings, h.title)
+	}
+	if entry.Title == "" {
+		entry.Title = pageTitle(pageInfo{filename: filepath.ToSlash(rel), fm: c.pageFm})
+	}
+	c.searchIndex = append(c.searchIndex, entry)
+}
+
+// buildSearchPage() publishes the search results page if
+// search is on and the project doesn't have its own
+// search.md. The page is built from .poco/search/search.md
+// using the site's theme.
+func (c *config) buildSearchPage() {
+	if !c.searchEnabled() || fileExists(filepath.Join(c.root, searchPageFilename)) {
+		return
+	}
+	source := filepath.Join(c.pocoDir, searchDir, searchPageFilename)
+	if !fileExists(source) {
+		return
+	}
+	// The page is published as if it were search.md
+	// in the project root.
+	c.currentFilename = filepath.Join(c.root, searchPageFilename)
+	HTML, _ := buildFileToTemplatedString(c, source)
+	target := filepath.Join(c.webroot, replaceExtension(searchPageFilename, "html"))
+	stringToFile(c, target, HTML)
+	c.mdCopied++
+}
+
+// writeSearchIndex() publishes the search index as
+// JSON in the webroot, if search is on.
+func (c *config) writeSearchIndex() {
+	if !c.searchEnabled() {
+		return
+	}
+	b, err := json.Marshal(c.searchIndex)
+	if err != nil {
+		quit(1, err, c, "Unable to create search index")
+	}
+	stringToFile(c, filepath.Join(c.webroot, searchIndexFilename), string(b))
+}
+
+// searchHTML() returns a search box for the nav or header.
+// It's available to templates as search:
+//
+//	{{ search }}
+//
+// Returns "" unless search is on.
+func (c *config) searchHTML() template.HTML {
+	if !c.searchEnabled() {
+		return ""
 	}
-	if parsedHTML, err = doTemplate(filename, string(b), c); err != nil {
-		quit(1, err, c, "%v: Problem executing template code", filename)
+	return template.HTML(`<form class="search-poco" role="search" action="` +
+		pageURL(searchPageFilename) + `" data-index="/` + searchIndexFilename + `">` +
+		`<input type="search" name="q" placeholder="Search" aria-label="Search" autocomplete="off">` +
+		`</form>`)
+}
+
+// searchResultsHTML() returns the element on the search page
+// that the search script fills with results. It's available to
+// templates as searchresults:
+//
+//	{{ searchresults }}
+func (c *config) searchResultsHTML() template.HTML {
+	if !c.searchEnabled() {
+		return ""
+	}
+	return template.HTML(`<div id="search-results-poco" aria-live="polite"></div>`)
+}
+
+// searchJs() returns the Javascript for the search box and
+// results page if search is on. It consists of every .js file
+// in the .poco/js/search directory, in alphabetical order.
+func (c *config) searchJs() string {
+	if !c.searchEnabled() {
+		return ""
+	}
+	return c.jsDirString(jsSearchDir)
+}
+
+// PAGE AND MENU UTILITIES
+
+// pageInfo describes one Markdown page in the project.
+type pageInfo struct {
+	// Source filename relative to the project root
+	filename string
+
+	// Root-relative URL of the published page, e.g. /docs/intro.html
+	url string
+
+	// Language of the page, and its filename without the
+	// language, shared by all its translations. See langOf().
+	lang string
+	key  string
+
+	// Front matter for the page
+	fm map[string]interface{}
+
+	// Last commit of the source file, or nil outside a git repository
+	git *gitInfo
+
+	// When the source file last changed according to git,
+	// or its modification time outside a git repository
+	lastmod time.Time
+}
+
+// menuEntry is one item in a menu.
+type menuEntry struct {
+	Title  string
+	URL    string
+	Weight int
+	// True if this entry links to the page being built
+	Active bool
+	// Language of the page linked to, in multilingual sites
+	lang string
+}
+
+// collectPages() reads the front matter of every Markdown
+// page in the project into c.pages, then builds c.menus.
+// Pre: c.skipPublish, c.homePage
+func (c *config) collectPages() {
+	c.pages = []pageInfo{}
+	c.sections = nil
+	var count int
+	files, _ := c.getProjectTree(".", &count, c.skipPublish)
+	if c.homePage != "" {
+		files = append([]string{filepath.Base(c.homePage)}, files...)
+	}
+	for _, filename := range files {
+		if !c.markdownExtensions.Found(path.Ext(filename)) {
+			continue
+		}
+		c.currentFilename = filepath.Join(c.root, filename)
+		rel := filepath.ToSlash(filename)
+		lang, key := c.langOf(rel)
+		c.pages = append(c.pages, pageInfo{
+			filename: rel,
+			url:      pageURL(c.langPath(rel)),
+			lang:     lang,
+			key:      key,
+			fm:       c.getFm(c.currentFilename),
+			git:      c.gitLog[rel],
+			lastmod:  c.fileLastmod(rel),
+		})
+	}
+	c.buildMenus()
+}
+
+// pageURL() converts a Markdown filename relative to the
+// project root to the root-relative URL of its HTML file.
+// The home page is simply "/".
+func pageURL(filename string) string {
+	filename = filepath.ToSlash(filename)
+	if filename == "README.md" || filename == "index.md" {
+		return "/"
+	}
+	return "/" + replaceExtension(filename, "html")
+}
+
+// pageTitle() returns the title to use for a page in
+// menus and the like: menutitle: if present, then title:,
+// then the filename with its extension removed.
+func pageTitle(p pageInfo) string {
+	if title := fmStr("menutitle", p.fm); title != "" {
+		return title
+	}
+	if title := fmStr("title", p.fm); title != "" {
+		return title
+	}
+	return strings.TrimSuffix(path.Base(p.filename), path.Ext(p.filename))
+}
+
+// menuLinkRe matches a menus: entry written as a
+// Markdown link, e.g. [GitHub](https://github.com/pococms/poco)
+var menuLinkRe = regexp.MustCompile(`^\[(.*)\]\((.*)\)$`)
+
+// buildMenus() creates c.menus. Pages join a menu
+// through their front matter:
+//
+// ---
+// menu: main
+// weight: 20
+// ---
+//
+// menu: can also be a list of menu names. Entries are sorted by
+// weight, then by title.
+// Alternatively the home page can spell out a menu in order,
+// using source filenames or Markdown links. A menu listed
+// this way ignores menu: in page front matter.
+//
+// ---
+// menus:
+//
+//	main:
+//	- index.md
+//	- docs/intro.md
+//	- "[GitHub](https://github.com/pococms/poco)"
+//
+// ---
+func (c *config) buildMenus() {
+	c.menus = map[string][]menuEntry{}
+	for _, p := range c.pages {
+		names := fmStrSlice("menu", p.fm)
+		if name := fmStr("menu", p.fm); name != "" {
+			names = []string{name}
+		}
+		for _, name := range names {
+			c.menus[name] = append(c.menus[name], menuEntry{
+				Title:  pageTitle(p),
+				URL:    p.url,
+				Weight: fmInt("weight", p.fm),
+				lang:   p.lang,
+			})
+		}
+	}
+	for name := range c.menus {
+		menu := c.menus[name]
+		sort.SliceStable(menu, func(i, j int) bool {
+			if menu[i].Weight != menu[j].Weight {
+				return menu[i].Weight < menu[j].Weight
+			}
+			return menu[i].Title < menu[j].Title
+		})
+	}
+
+	// Menus spelled out on the home page take priority.
+	var homeFm map[string]interface{}
+	if len(c.pages) > 0 && c.homePage != "" {
+		homeFm = c.pages[0].fm
+	}
+	menus, _ := homeFm["menus"].(map[interface{}]interface{})
+	for k, v := range menus {
+		name := fmt.Sprintf("%v", k)
+		items, _ := v.([]interface{})
+		menu := []menuEntry{}
+		for _, item := range items {
+			entry := fmt.Sprintf("%v", item)
+			if m := menuLinkRe.FindStringSubmatch(entry); m != nil {
+				menu = append(menu, menuEntry{Title: m[1], URL: m[2]})
+				continue
+			}
+			p := c.findPage(entry)
+			if p == nil {
+				quit(1, nil, c, "Menu %s lists %s, which isn't a page in this project", name, entry)
+			}
+			menu = append(menu, menuEntry{Title: pageTitle(*p), URL: p.url, lang: p.lang})
+		}
+		c.menus[name] = menu
+	}
+}
+
+// findPage() returns the page whose source filename,
+// relative to the project root, is filename.
+// Returns nil if there's no such page.
+func (c *config) findPage(filename string) *pageInfo {
+	filename = path.Clean(filepath.ToSlash(filename))
+	for i := range c.pages {
+		if c.pages[i].filename == filename {
+			return &c.pages[i]
+		}
+	}
+	return nil
+}
+
+// currentURL() returns the root-relative URL of the page being built.
+func (c *config) currentURL() string {
+	rel, err := filepath.Rel(c.root, c.currentFilename)
+	if err != nil {
+		return ""
+	}
+	return pageURL(c.langPath(filepath.ToSlash(rel)))
+}
+
+// menuItems() returns the named menu with the current page
+// marked active. It's available to templates as menuitems,
+// so a theme can produce its own markup:
+//
+// {{ range menuitems "main" }}<a href="{{.URL}}">{{.Title}}</a>{{ end }}
+func (c *config) menuItems(name string) []menuEntry {
+	current := c.currentURL()
+	items := []menuEntry{}
+	lang := c.currentLang()
+	for _, entry := range c.menus[name] {
+		// Only list pages in the current page's language
+		if c.multilingual() && entry.lang != "" && entry.lang != lang {
+			continue
+		}
+		entry.Active = entry.URL == current
+		items = append(items, entry)
+	}
+	return items
+}
+
+// currentMenus() returns every menu with the current page marked active.
+func (c *config) currentMenus() map[string][]menuEntry {
+	menus := map[string][]menuEntry{}
+	for name := range c.menus {
+		menus[name] = c.menuItems(name)
+	}
+	return menus
+}
+
+// menuHTML() renders the named menu as an unordered list,
+// marking the current page with aria-current. It's available
+// to templates as menu, so a nav.md file can be as simple as:
+//
+// {{ menu "main" }}
+func (c *config) menuHTML(name string) template.HTML {
+	items := c.menuItems(name)
+	if len(items) == 0 {
+		return ""
+	}
+	s := "\n<ul>\n"
+	for _, entry := range items {
+		current := ""
+		if entry.Active {
+			current = ` aria-current="page"`
+		}
+		s += "<li><a href=\"" + template.HTMLEscapeString(entry.URL) + "\"" + current + ">" +
+			template.HTMLEscapeString(entry.Title) + "</a></li>\n"
+	}
+	return template.HTML(s + "</ul>\n")
+}
+
+// SECTION UTILITIES
+//
+// Each directory in the project is a section, titled by its
+// index page (index.md or README.md). Breadcrumbs lead from
+// the home page through the sections containing the current
+// page, and prev/next link to the page's siblings in its
+// section, in order of weight: and then filename. A theme
+// can put them in a header or footer layout element:
+//
+// {{ breadcrumbmenu }}
+// ...
+// {{ pagenav }}
+//
+// or build its own markup from breadcrumbs, prevpage,
+// and nextpage. Section index pages have no siblings.
+
+// isIndexPage() returns true if key, a page's filename
+// without its language, is the index page of its directory.
+func isIndexPage(key string) bool {
+	base := path.Base(key)
+	return base == "index.md" || base == "README.md"
+}
+
+// sectionIndex() returns the index page of the
+// directory dir in lang, or nil if it has none.
+func (c *config) sectionIndex(dir string, lang string) *pageInfo {
+	for _, index := range []string{"index.md", "README.md"} {
+		key := path.Join(dir, index)
+		for i := range c.pages {
+			if c.pages[i].key == key && c.pages[i].lang == lang {
+				return &c.pages[i]
+			}
+		}
+	}
+	return nil
+}
+
+// breadcrumbItems() returns the trail from the home page
+// through the index page of each directory containing the
+// current page, ending with the page itself, marked active.
+// Directories without an index page are skipped. It's
+// available to templates as breadcrumbs.
+func (c *config) breadcrumbItems() []menuEntry {
+	rel := c.currentRel()
+	lang, key := c.langOf(rel)
+	crumbs := []menuEntry{}
+	home := c.sectionIndex(".", lang)
+	title := c.siteName()
+	if title == "" && home != nil {
+		title = pageTitle(*home)
+	}
+	if title == "" {
+		title = "Home"
+	}
+	url := "/"
+	if home != nil {
+		url = home.url
+	}
+	crumbs = append(crumbs, menuEntry{Title: title, URL: url, Active: home != nil && home.key == key, lang: lang})
+	if home != nil && home.key == key {
+		return crumbs
+	}
+	dirs := strings.Split(path.Dir(key), "/")
+	for i := range dirs {
+		if dirs[0] == "." {
+			break
+		}
+		if p := c.sectionIndex(strings.Join(dirs[:i+1], "/"), lang); p != nil && p.key != key {
+			crumbs = append(crumbs, menuEntry{Title: pageTitle(*p), URL: p.url, lang: lang})
+		}
+	}
+	title = fmStr("title", c.pageFm)
+	if title == "" {
+		title = pageTitle(pageInfo{filename: rel, fm: c.pageFm})
+	}
+	return append(crumbs, menuEntry{Title: title, URL: c.currentURL(), Active: true, lang: lang})
+}
+
+// siblings() returns the pages in the same directory and
+// language as the current page, including it, ordered by
+// weight: and then filename, with pages that have no
+// weight after those that do. Index pages and the
+// not-found page are left out. Returns nil if the current
+// page is itself an index page.
+func (c *config) siblings() []pageInfo {
+	lang, key := c.langOf(c.currentRel())
+	if isIndexPage(key) {
+		return nil
+	}
+	if c.sections == nil {
+		c.buildSections()
+	}
+	return c.sections[lang+":"+path.Dir(key)]
+}
+
+// buildSections() sorts c.pages into c.sections once,
+// so finding a page's siblings doesn't mean going
+// through every page each time.
+func (c *config) buildSections() {
+	c.sections = map[string][]pageInfo{}
+	for _, p := range c.pages {
+		if isIndexPage(p.key) || c.isNotFoundPage(p.filename) {
+			continue
+		}
+		section := p.lang + ":" + path.Dir(p.key)
+		c.sections[section] = append(c.sections[section], p)
+	}
+	for _, pages := range c.sections {
+		sort.SliceStable(pages, func(i, j int) bool {
+			wi, wj := fmInt("weight", pages[i].fm), fmInt("weight", pages[j].fm)
+			switch {
+			case wi == wj:
+				return pages[i].key < pages[j].key
+			case wi == 0:
+				return false
+			case wj == 0:
+				return true
+			}
+			return wi < wj
+		})
+	}
+}
+
+// sibling() returns the page offset places from the
+// current one among its siblings, or nil if there's none.
+func (c *config) sibling(offset int) *menuEntry {
+	pages := c.siblings()
+	for i, p := range pages {
+		if p.filename != c.currentRel() {
+			continue
+		}
+		if i+offset < 0 || i+offset >= len(pages) {
+			return nil
+		}
+		p = pages[i+offset]
+		return &menuEntry{Title: pageTitle(p), URL: p.url, Weight: fmInt("weight", p.fm), lang: p.lang}
+	}
+	return nil
+}
+
+// prevPage() returns the previous page in the current
+// page's section, or nil. It's available to templates
+// as prevpage.
+func (c *config) prevPage() *menuEntry {
+	return c.sibling(-1)
+}
+
+// nextPage() returns the next page in the current
+// page's section, or nil. It's available to templates
+// as nextpage.
+func (c *config) nextPage() *menuEntry {
+	return c.sibling(1)
+}
+
+// breadcrumbMenuHTML() returns the breadcrumbs as an
+// ordered list. It's available to templates as breadcrumbmenu.
+func (c *config) breadcrumbMenuHTML() template.HTML {
+	crumbs := c.breadcrumbItems()
+	if len(crumbs) < 2 {
+		return ""
+	}
+	s := "\n<nav class=\"breadcrumbs-poco\" aria-label=\"Breadcrumb\">\n<ol>\n"
+	for _, crumb := range crumbs {
+		if crumb.Active {
+			s += "<li aria-current=\"page\">" + template.HTMLEscapeString(crumb.Title) + "</li>\n"
+			continue
+		}
+		s += "<li><a href=\"" + template.HTMLEscapeString(crumb.URL) + "\">" +
+			template.HTMLEscapeString(crumb.Title) + "</a></li>\n"
+	}
+	return template.HTML(s + "</ol>\n</nav>\n")
+}
+
+// pageNavHTML() returns links to the previous and next
+// pages in the section. It's available to templates as pagenav.
+func (c *config) pageNavHTML() template.HTML {
+	prev, next := c.prevPage(), c.nextPage()
+	if prev == nil && next == nil {
+		return ""
+	}
+	s := "\n<nav class=\"pagenav-poco\" aria-label=\"Pages in this section\">\n"
+	if prev != nil {
+		s += "<a rel=\"prev\" href=\"" + template.HTMLEscapeString(prev.URL) + "\">&larr; " +
+			template.HTMLEscapeString(prev.Title) + "</a>\n"
+	}
+	if next != nil {
+		s += "<a rel=\"next\" href=\"" + template.HTMLEscapeString(next.URL) + "\">" +
+			template.HTMLEscapeString(next.Title) + " &rarr;</a>\n"
+	}
+	return template.HTML(s + "</nav>\n")
+}
+
+// MULTILINGUAL UTILITIES
+//
+// A site becomes multilingual when its home page
+// lists languages, default first:
+//
+//	---
+//	languages: [en, fr, de]
+//	---
+//
+// Translations live either in content/<lang>/, for example,
+// content/fr/docs/intro.md, or next to the original with the
+// language before the extension, for example, docs/intro.fr.md.
+// Either way the French page is published as /fr/docs/intro.html.
+// Pages in the default language are published as usual.
+
+// Directory holding each language's pages in a multilingual site
+const contentDir = "content"
+
+// Directory holding translated UI strings, for example, i18n/fr.yaml
+const i18nDir = "i18n"
+
+// languageLink is one entry in a language switcher.
+type languageLink struct {
+	// Language code, for example, fr
+	Code string
+	// Name of the language, from languagename: in its
+	// i18n file, or else its code
+	Name string
+	// The translation of the current page, or else
+	// the home page for that language
+	URL string
+	// True if this is the current page's language
+	Current bool
+}
+
+// loadLanguages() reads the list of languages from the
+// home page and the translated UI strings for each one.
+// Does nothing unless the site is multilingual.
+func (c *config) loadLanguages() {
+	if c.homePage == "" {
+		return
+	}
+	c.languages = fmStrSlice("languages", c.getFm(c.homePage))
+	if !c.multilingual() {
+		return
+	}
+	// The UI strings aren't pages
+	c.skipPublish.AddStr(i18nDir)
+	c.translations = map[string]map[string]string{}
+	for _, lang := range c.languages {
+		strs := map[string]string{}
+		filename := filepath.Join(c.root, i18nDir, lang+".yaml")
+		if fileExists(filename) {
+			m := map[string]interface{}{}
+			if err := yaml.Unmarshal(fileToBuf(filename), &m); err != nil {
+				quit(1, err, c, "Unable to read translations in %s", filename)
+			}
+			for k, v := range m {
+				strs[strings.ToLower(k)] = fmt.Sprint(v)
+			}
+		}
+		c.translations[lang] = strs
+	}
+}
+
+// multilingual() reports whether the home page lists languages.
+func (c *config) multilingual() bool {
+	return len(c.languages) > 0
+}
+
+// defaultLang() returns the language of pages that
+// aren't translations.
+func (c *config) defaultLang() string {
+	if c.multilingual() {
+		return c.languages[0]
+	}
+	return c.lang
+}
+
+// langOf() returns the language of the file at rel, a
+// slash-separated path relative to the project root, and
+// its path without the language, which is the same for
+// all translations of a page. For example,
+// content/fr/docs/intro.md and docs/intro.fr.md both
+// return fr and docs/intro.md.
+func (c *config) langOf(rel string) (string, string) {
+	if !c.multilingual() {
+		return c.lang, rel
+	}
+	parts := strings.SplitN(rel, "/", 3)
+	if len(parts) == 3 && parts[0] == contentDir && slices.Contains(c.languages, parts[1]) {
+		return parts[1], parts[2]
+	}
+	ext := path.Ext(rel)
+	base := strings.TrimSuffix(rel, ext)
+	if lang := strings.TrimPrefix(path.Ext(base), "."); lang != "" &&
+		slices.Contains(c.languages, lang) && c.markdownExtensions.Found(ext) {
+		return lang, strings.TrimSuffix(base, "."+lang) + ext
+	}
+	return c.defaultLang(), rel
+}
+
+// langPath() returns where the file at rel, a slash-separated
+// path relative to the project root, is published relative
+// to the webroot, before any change of extension.
+// Translations go under a directory named for the language.
+func (c *config) langPath(rel string) string {
+	lang, key := c.langOf(rel)
+	if lang == c.defaultLang() {
+		return key
+	}
+	return lang + "/" + key
+}
+
+// currentLang() returns the language of the page being built.
+func (c *config) currentLang() string {
+	rel, err := filepath.Rel(c.root, c.currentFilename)
+	if err != nil {
+		return c.defaultLang()
+	}
+	lang, _ := c.langOf(filepath.ToSlash(rel))
+	return lang
+}
+
+// translationsOf() returns every version of the page at rel,
+// including itself, keyed by language.
+func (c *config) translationsOf(rel string) map[string]*pageInfo {
+	_, key := c.langOf(rel)
+	pages := map[string]*pageInfo{}
+	for i := range c.pages {
+		if c.pages[i].key == key {
+			pages[c.pages[i].lang] = &c.pages[i]
+		}
+	}
+	return pages
+}
+
+// languageName() returns languagename: from the
+// language's i18n file, or else its code.
+func (c *config) languageName(lang string) string {
+	if name := c.translations[lang]["languagename"]; name != "" {
+		return name
+	}
+	return lang
+}
+
+// languageLinks() returns the language switcher for the current
+// page. It's available to templates as languages:
+//
+//	{{ range languages }}<a href="{{ .URL }}">{{ .Name }}</a>{{ end }}
+//
+// Languages without a translation of the page link to their
+// home page, or are left out if they don't have one.
+func (c *config) languageLinks() []languageLink {
+	if !c.multilingual() {
+		return nil
+	}
+	rel, _ := filepath.Rel(c.root, c.currentFilename)
+	rel = filepath.ToSlash(rel)
+	translations := c.translationsOf(rel)
+	current := c.currentLang()
+	links := []languageLink{}
+	for _, lang := range c.languages {
+		url := ""
+		if p, ok := translations[lang]; ok {
+			url = p.url
+		} else if lang == c.defaultLang() {
+			url = "/"
+		} else {
+			for _, index := range []string{"index.md", "README.md"} {
+				if p, ok := c.translationsOf(index)[lang]; ok {
+					url = p.url
+					break
+				}
+			}
+		}
+		if url == "" {
+			continue
+		}
+		links = append(links, languageLink{Code: lang, Name: c.languageName(lang), URL: url, Current: lang == current})
+	}
+	return links
+}
+
+// languageMenuHTML() returns the language switcher as a list
+// of links. It's available to templates as languagemenu:
+//
+//	{{ languagemenu }}
+func (c *config) languageMenuHTML() template.HTML {
+	links := c.languageLinks()
+	if len(links) == 0 {
+		return ""
+	}
+	s := "\n<ul class=\"languages-poco\">\n"
+	for _, link := range links {
+		current := ""
+		if link.Current {
+			current = ` aria-current="page"`
+		}
+		s += "<li><a href=\"" + template.HTMLEscapeString(link.URL) + "\" hreflang=\"" + link.Code +
+			"\" lang=\"" + link.Code + "\"" + current + ">" + template.HTMLEscapeString(link.Name) + "</a></li>\n"
+	}
+	return template.HTML(s + "</ul>\n")
+}
+
+// translate() returns the UI string named key in the current
+// page's language, from i18n/<lang>.yaml. Falls back to the
+// default language, then to key itself. It's available to
+// templates, including layout elements, as i18n:
+//
+//	{{ i18n "readmore" }}
+func (c *config) translate(key string) string {
+	key = strings.ToLower(key)
+	if s, ok := c.translations[c.currentLang()][key]; ok {
+		return s
+	}
+	if s, ok := c.translations[c.defaultLang()][key]; ok {
+		return s
+	}
+	return key
+}
+
+// hreflangTags() returns alternate link tags pointing
+// search engines to each translation of the current page.
+func (c *config) hreflangTags() string {
+	if !c.multilingual() {
+		return ""
+	}
+	rel, _ := filepath.Rel(c.root, c.currentFilename)
+	translations := c.translationsOf(filepath.ToSlash(rel))
+	if len(translations) < 2 {
+		return ""
+	}
+	tags := ""
+	link := func(lang, url string) {
+		tags += "\t<link rel=\"alternate\" hreflang=\"" + lang + "\" href=\"" +
+			htmlstd.EscapeString(c.absURL(url)) + "\">\n"
+	}
+	for _, lang := range c.languages {
+		if p, ok := translations[lang]; ok {
+			link(lang, p.url)
+		}
+	}
+	if p, ok := translations[c.defaultLang()]; ok {
+		link("x-default", p.url)
 	}
-	return parsedHTML
+	return tags
 }
 
-// mdYAMLtoHTML converts the Markdown file, which may
-// have front matter, to HTML. The  front matter
-// is one of the return values.
-func mdYAMLToHTML(source []byte) ([]byte, map[string]interface{}, error) {
+// SITEMAP AND FEED UTILITIES
+//
+// Sitemaps and Atom feeds need absolute URLs, so they're
+// only published if the home page has a baseurl:. Each
+// language gets its own, for example, /sitemap.xml and
+// /feed.xml for the default language, /fr/sitemap.xml and
+// /fr/feed.xml for French. A page can leave either out
+// with sitemap: false or feed: false.
+
+// Names of the sitemap and feed files
+const sitemapFilename = "sitemap.xml"
+const feedFilename = "feed.xml"
+
+// Most entries in a feed
+const feedLimit = 20
+
+// sitemapURLSet is the root element of a sitemap.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Xhtml   string       `xml:"xmlns:xhtml,attr,omitempty"`
+	URLs    []sitemapURL `xml:"url"`
+}
 
-	mdParser := newGoldmark()
-	mdParserCtx := parser.NewContext()
+// sitemapURL is one page in a sitemap.
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod,omitempty"`
+	// Translations of the page
+	Alternates []sitemapLink `xml:"xhtml:link"`
+}
 
-	document := mdParser.Parser().Parse(text.NewReader([]byte(source)))
-	metaData := document.OwnerDocument().Meta()
-	var buf bytes.Buffer
-	// Convert Markdown source to HTML and deposit in buf.Bytes().
-	if err := mdParser.Convert(source, &buf, parser.WithContext(mdParserCtx)); err != nil {
-		return []byte{}, nil, err
-	}
-	// Obtain YAML front matter from document.
-	return buf.Bytes(), metaData, nil
+// sitemapLink points a sitemap entry to a translation.
+type sitemapLink struct {
+	Rel      string `xml:"rel,attr"`
+	Hreflang string `xml:"hreflang,attr"`
+	Href     string `xml:"href,attr"`
 }
 
-// PROMPT UTILITIES
-// See also wait(), which prints a message and awaits 'q' or Enter.
+// atomFeed is the root element of an Atom feed.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Lang    string      `xml:"xml:lang,attr,omitempty"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
 
-// inputString() gets a string from the keyboard and returns it
-// See also promptString()
-func inputString() string {
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	return scanner.Text()
+// atomLink is a link in an Atom feed or entry.
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
 }
 
-// promptString() displays a prompt, then awaits for keyboard
-// input and returns it on completion.
-// See also inputString(), promptYes()
-func promptString(format string, ss ...interface{}) string {
-	fmt.Print(fmtMsg(format, ss...))
-	fmt.Print(" ")
-	return inputString()
+// atomEntry is one page in an Atom feed.
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published,omitempty"`
+	Updated   string      `xml:"updated"`
+	Summary   string      `xml:"summary,omitempty"`
+	Author    *atomAuthor `xml:"author,omitempty"`
 }
 
-// promptStringDefault() displays a prompt, then awaits for keyboard
-// input and returns it on completion. It precedes the end of the
-// prompt with a default value in brackets.
-// See also inputString(), promptYes()
-func promptStringDefault(prompt string, defaultValue string) string {
-	answer := promptString(prompt + " [" + defaultValue + "] ")
-	if answer == "" {
-		return defaultValue
-	} else {
-		return answer
+// atomAuthor is the author of an Atom entry.
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+// fmTime() returns a date from the front matter,
+// such as date: 2024-05-01, as a time.
+func fmTime(key string, fm map[string]interface{}) (time.Time, bool) {
+	switch v := fm[strings.ToLower(key)].(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
 	}
+	return time.Time{}, false
 }
 
-// SERVER UTILITIES
+// pageModified() returns when the page was last changed:
+// its modified: front matter, or else the date of its last
+// commit or its file modification time, or else its date:.
+func pageModified(p pageInfo) (time.Time, bool) {
+	if t, ok := fmTime("modified", p.fm); ok {
+		return t, true
+	}
+	if !p.lastmod.IsZero() {
+		return p.lastmod, true
+	}
+	return fmTime("date", p.fm)
+}
 
-// serve is the world's simplest web server, for quick tests
-// only. c.port is a string like ":12345" and c.webroot is the
-// pathname of the directory to serve static files from.
-func (c *config) serve() {
-	if !strings.HasPrefix(c.port, ":") {
-		c.port = ":" + c.port
+// langDir() returns the directory in the webroot
+// holding pages in lang.
+func (c *config) langDir(lang string) string {
+	if lang == c.defaultLang() {
+		return c.webroot
 	}
-	if portBusy(c.port) {
-		print("Port %s is already in use", c.port)
-		os.Exit(1)
+	return filepath.Join(c.webroot, lang)
+}
+
+// siteLanguages() returns every language the site is published in.
+func (c *config) siteLanguages() []string {
+	if c.multilingual() {
+		return c.languages
 	}
-	if err := os.Chdir(c.webroot); err != nil {
-		quit(1, err, c, "Unable to change to webroot directory %s", c.root)
+	return []string{c.lang}
+}
+
+// writeXML() publishes v as an XML file.
+func (c *config) writeXML(filename string, v interface{}) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		quit(1, err, c, "Unable to create %s", filename)
 	}
-	// Simple static webserver:
-	print("\n%s Web server running at:\n\nhttp://localhost%s\n\nTo stop the web server, press Ctrl+C", theTime(), c.port)
-	if err := http.ListenAndServe(c.port, http.FileServer(http.Dir(c.webroot))); err != nil {
-		quit(1, err, c, "Error running web server")
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		quit(1, err, c, "Unable to create directory %s", filepath.Dir(filename))
 	}
+	stringToFile(c, filename, xml.Header+string(b)+"\n")
 }
 
-// theTime returns the current time as a string.
-// Nothing configurable b/c it's just used for timestamping
-// every page, a dumb diagnostic tool
-func theTime() string {
-	t := time.Now()
-	s := fmt.Sprintf("%s", t.Format("02 Jan 2006 15:04:05"))
-	return s
+// writeSitemaps() publishes a sitemap for each language.
+func (c *config) writeSitemaps() {
+	if fmStr("baseurl", c.globalFm) == "" {
+		return
+	}
+	for _, lang := range c.siteLanguages() {
+		set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+		if c.multilingual() {
+			set.Xhtml = "http://www.w3.org/1999/xhtml"
+		}
+		for _, p := range c.pages {
+			if p.lang != lang {
+				continue
+			}
+			if on, ok := p.fm["sitemap"].(bool); (ok && !on) || c.isNotFoundPage(p.filename) {
+				continue
+			}
+			u := sitemapURL{Loc: c.absURL(p.url)}
+			if t, ok := pageModified(p); ok {
+				u.Lastmod = t.Format("2006-01-02")
+			}
+			if translations := c.translationsOf(p.filename); len(translations) > 1 {
+				for _, l := range c.languages {
+					if t, ok := translations[l]; ok {
+						u.Alternates = append(u.Alternates, sitemapLink{Rel: "alternate", Hreflang: l, Href: c.absURL(t.url)})
+					}
+				}
+			}
+			set.URLs = append(set.URLs, u)
+		}
+		if len(set.URLs) > 0 {
+			c.writeXML(filepath.Join(c.langDir(lang), sitemapFilename), set)
+		}
+	}
 }
 
-// portBusy() returns true if the port
-// (in the form ":12345" is already in use.
-func portBusy(port string) bool {
-	ln, err := net.Listen("tcp", port)
-	if err != nil {
-		return true
+// writeFeeds() publishes an Atom feed for each language
+// listing its newest pages with a date: in their front matter.
+func (c *config) writeFeeds() {
+	if fmStr("baseurl", c.globalFm) == "" {
+		return
 	}
-	err = ln.Close()
+	for _, lang := range c.siteLanguages() {
+		type dated struct {
+			p         pageInfo
+			published time.Time
+			updated   time.Time
+		}
+		pages := []dated{}
+		for _, p := range c.pages {
+			if p.lang != lang {
+				continue
+			}
+			if on, ok := p.fm["feed"].(bool); ok && !on {
+				continue
+			}
+			published, ok := fmTime("date", p.fm)
+			if !ok {
+				continue
+			}
+			updated, _ := pageModified(p)
+			pages = append(pages, dated{p, published, updated})
+		}
+		if len(pages) == 0 {
+			continue
+		}
+		sort.SliceStable(pages, func(i, j int) bool { return pages[i].published.After(pages[j].published) })
+		if len(pages) > feedLimit {
+			pages = pages[:feedLimit]
+		}
+		home := "/"
+		if lang != c.defaultLang() {
+			home = "/" + lang + "/"
+		}
+		title := c.siteName()
+		if title == "" {
+			title = fmStr("baseurl", c.globalFm)
+		}
+		feed := atomFeed{
+			Title: title,
+			ID:    c.absURL(home),
+			Link:  atomLink{Href: c.absURL(home + feedFilename), Rel: "self"},
+		}
+		if c.multilingual() {
+			feed.Lang = lang
+		}
+		latest := time.Time{}
+		for _, d := range pages {
+			entry := atomEntry{
+				Title:     pageTitle(d.p),
+				ID:        c.absURL(d.p.url),
+				Link:      atomLink{Href: c.absURL(d.p.url)},
+				Published: d.published.Format(time.RFC3339),
+				Updated:   d.updated.Format(time.RFC3339),
+				Summary:   fmStr("description", d.p.fm),
+			}
+			author := fmStr("author", d.p.fm)
+			if author == "" {
+				author = fmStr("author", c.globalFm)
+			}
+			if author != "" {
+				entry.Author = &atomAuthor{Name: author}
+			}
+			if d.updated.After(latest) {
+				latest = d.updated
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+		feed.Updated = latest.Format(time.RFC3339)
+		c.writeXML(filepath.Join(c.langDir(lang), feedFilename), feed)
+	}
+}
+
+// GIT UTILITIES
+//
+// If the project is in a git repository, each page's last
+// commit is available to layout.html as .GitInfo, with the
+// date as .Lastmod, so a theme can show something like:
+//
+//	Last updated {{ .Lastmod.Format "January 2, 2006" }}
+//	by {{ .GitInfo.AuthorName }}
+//
+// Markdown pages, partials, and layout elements use the
+// lastmod and gitinfo template functions instead. Outside
+// a repository the file modification time is used and
+// GitInfo is nil.
+
+// gitInfo describes the last commit to change a file.
+type gitInfo struct {
+	Hash            string
+	AbbreviatedHash string
+	AuthorName      string
+	AuthorEmail     string
+	Date            time.Time
+	Subject         string
+}
+
+// gitLogFormat is the git log --format for each commit
+// read by parseGitLog(). The fields are separated by
+// the unit separator, and each commit starts with the
+// record separator so it can't be mistaken for a filename.
+const gitLogFormat = "%x1e%H%x1f%h%x1f%an%x1f%ae%x1f%aI%x1f%s"
+
+// loadGitLog() reads the last commit to change every file in
+// the project into c.gitLog, using a single git log. Leaves
+// c.gitLog empty if git or the repository isn't available.
+func (c *config) loadGitLog() {
+	c.gitLog = map[string]*gitInfo{}
+	cmd := exec.Command("git", "-c", "core.quotepath=off", "log", "--no-merges", "--relative", "--name-only", "--format="+gitLogFormat, "--", ".")
+	cmd.Dir = c.root
+	out, err := cmd.Output()
 	if err != nil {
-		quit(1, err, nil, "Problem closing port")
+		c.verbose("No git history for %s", c.root)
+		return
 	}
+	c.gitLog = parseGitLog(string(out))
+}
 
-	return false
+// parseGitLog() converts the output of the git log run by
+// loadGitLog() to the newest commit for each filename. The
+// filenames are slash-separated and relative to the project root.
+func parseGitLog(log string) map[string]*gitInfo {
+	files := map[string]*gitInfo{}
+	for _, record := range strings.Split(log, "\x1e") {
+		lines := strings.Split(record, "\n")
+		fields := strings.Split(lines[0], "\x1f")
+		if len(fields) != 6 {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, fields[4])
+		if err != nil {
+			continue
+		}
+		commit := &gitInfo{
+			Hash:            fields[0],
+			AbbreviatedHash: fields[1],
+			AuthorName:      fields[2],
+			AuthorEmail:     fields[3],
+			Date:            date,
+			Subject:         fields[5],
+		}
+		for _, filename := range lines[1:] {
+			// Commits are newest first
+			if _, ok := files[filename]; filename != "" && !ok {
+				files[filename] = commit
+			}
+		}
+	}
+	return files
 }
 
-// MINIFY
+// fileLastmod() returns when the file at rel, relative to
+// the project root, last changed: the date of its last
+// commit, or else its modification time.
+func (c *config) fileLastmod(rel string) time.Time {
+	if commit, ok := c.gitLog[rel]; ok {
+		return commit.Date
+	}
+	if info, err := os.Stat(filepath.Join(c.root, filepath.FromSlash(rel))); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
 
-// METADATA UTILITIES/FRONT MATTER UTILITIES
+// pageLastmod() returns when the page at rel, relative to
+// the project root, last changed, counting changes to the
+// files it includes. Only pages already built have their
+// includes known.
+func (c *config) pageLastmod(rel string) time.Time {
+	latest := c.fileLastmod(rel)
+	for _, dep := range c.dependencies[filepath.Join(c.root, filepath.FromSlash(rel))] {
+		if t := c.fileLastmod(dep); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
 
-// fmStr is passed a front matter "type" and retrievs
-// the value for the value passed in as key. Value
-// is case-insensitive.
-func fmStr(key string, fm map[string]interface{}) string {
-	v := fm[strings.ToLower(key)]
-	value, ok := v.(string)
-	if !ok {
+// updatePageLastmods() brings the change dates of every
+// page up to date with the files each one includes, once
+// all pages have been built. Sitemaps and feeds use them.
+func (c *config) updatePageLastmods() {
+	for i := range c.pages {
+		c.pages[i].lastmod = c.pageLastmod(c.pages[i].filename)
+	}
+}
+
+// currentRel() returns the slash-separated path of the
+// page being built relative to the project root.
+func (c *config) currentRel() string {
+	return c.relToRoot(c.currentFilename)
+}
+
+// lastmod() returns when the current page last changed,
+// in the format given, as ftime does. It's available
+// to templates as lastmod:
+//
+// Last updated {{ lastmod "January 2, 2006" }}
+func (c *config) lastmod(param ...string) string {
+	format := "Mon Jan 2 15:04:05 -0700 MST 2006"
+	if len(param) > 0 {
+		format = param[0]
+	}
+	t := c.pageLastmod(c.currentRel())
+	if t.IsZero() {
 		return ""
 	}
-	return value
+	return t.Format(format)
 }
 
-// fmStrSlice obtains a list of string values from the supplied front matter.
-// For example, if you had this code in your Markdown file:
+// gitInfoFor() returns the last commit to change the
+// current page, or nil. It's available to templates
+// as gitinfo:
+//
+// {{ with gitinfo }}Changed in {{ .AbbreviatedHash }}{{ end }}
+func (c *config) gitInfoFor() *gitInfo {
+	return c.gitLog[c.currentRel()]
+}
+
+// NOT FOUND PAGE UTILITIES
+//
+// The page shown for missing URLs is 404.md in the project
+// root unless the home page names another:
 // ---
-// Stylesheets
-//   - 'https://cdn.jsdelivr.net/npm/holiday.css'
-//   - 'fonts.css'
+// notfound: missing.md
+// ---
+// Because a web server returns it at whatever path was
+// requested, its relative links are rewritten to root-relative
+// ones. It's left out of sitemaps and the search index.
+// Translations such as content/fr/404.md are not-found
+// pages too, used for missing paths under /fr/.
+
+// Default not-found page
+const notFoundFilename = "404.md"
+
+// notFoundPage() returns the filename of the not-found
+// page relative to the project root.
+func (c *config) notFoundPage() string {
+	if filename := fmStr("notfound", c.globalFm); filename != "" {
+		return path.Clean(filepath.ToSlash(filename))
+	}
+	return notFoundFilename
+}
+
+// isNotFoundPage() returns true if rel, a slash-separated
+// path relative to the project root, is the not-found page
+// or one of its translations.
+func (c *config) isNotFoundPage(rel string) bool {
+	_, key := c.langOf(path.Clean(rel))
+	return key == c.notFoundPage()
+}
+
+// currentIsNotFoundPage() returns true if the page
+// being built is the not-found page.
+func (c *config) currentIsNotFoundPage() bool {
+	rel, err := filepath.Rel(c.root, c.currentFilename)
+	if err != nil {
+		return false
+	}
+	return c.isNotFoundPage(filepath.ToSlash(rel))
+}
+
+// urlAttrRe matches HTML attributes holding a URL, or
+// a list of them in the case of srcset.
+var urlAttrRe = regexp.MustCompile(`(\s(?:href|src|poster|action|srcset)\s*=\s*")([^"]*)(")`)
+
+// rootRelativeLinks() rewrites every relative URL in the
+// HTML document html, which is published at the root-relative
+// URL base, so it works no matter what path it's served from.
+// For example, with base /docs/404.html, img/logo.png
+// becomes /docs/img/logo.png.
+func rootRelativeLinks(html string, base string) string {
+	baseURL := &url.URL{Path: base}
+	resolve := func(link string) string {
+		ref, err := url.Parse(link)
+		if err != nil || ref.Scheme != "" || ref.Host != "" ||
+			ref.Path == "" || strings.HasPrefix(ref.Path, "/") {
+			return link
+		}
+		return baseURL.ResolveReference(ref).String()
+	}
+	return urlAttrRe.ReplaceAllStringFunc(html, func(attr string) string {
+		m := urlAttrRe.FindStringSubmatch(attr)
+		if !strings.Contains(m[1], "srcset") {
+			return m[1] + resolve(m[2]) + m[3]
+		}
+		candidates := strings.Split(m[2], ",")
+		for i, candidate := range candidates {
+			fields := strings.Fields(candidate)
+			if len(fields) > 0 {
+				fields[0] = resolve(fields[0])
+				candidates[i] = strings.Join(fields, " ")
+			}
+		}
+		return m[1] + strings.Join(candidates, ", ") + m[3]
+	})
+}
+
+// notFoundURL() returns the root-relative URL of the
+// not-found page to show for the missing path urlPath,
+// preferring the translation for the language urlPath
+// is in. Returns "" if there's no not-found page.
+func (c *config) notFoundURL(urlPath string) string {
+	found := ""
+	for _, p := range c.pages {
+		if p.key != c.notFoundPage() {
+			continue
+		}
+		if p.lang == c.defaultLang() && found == "" {
+			found = p.url
+		}
+		if p.lang != c.defaultLang() && strings.HasPrefix(urlPath, "/"+p.lang+"/") {
+			return p.url
+		}
+	}
+	return found
+}
+
+// REDIRECT UTILITIES
 //
+// A page lists the URLs it used to have in its front matter:
+// ---
+// aliases:
+//   - /old/install.html
+//   - /setup/
+// ---
+// Each alias gets a small HTML page redirecting to the page's
+// current URL. An alias ending in / or with no extension gets
+// an index.html in that directory. The home page can also
+// publish the redirects in server formats:
+// ---
+// redirects:
+//   - netlify
+//   - nginx
+//   - apache
 // ---
 
-func fmStrSlice(key string, fm map[string]interface{}) []string {
-	if key == "" {
-		return []string{}
+// Files in the webroot for each redirects: format
+var redirectFiles = map[string]string{
+	"netlify": "_redirects",
+	"nginx":   "redirects.nginx.conf",
+	"apache":  ".htaccess",
+}
+
+// redirect is an old URL and the page now found elsewhere.
+type redirect struct {
+	// The alias as a root-relative URL, such as /old/install.html
+	From string
+	// Root-relative URL of the page redirected to
+	To string
+	// Root-relative path of the redirect page in the webroot,
+	// such as /setup/index.html
+	file string
+}
+
+// aliasRedirect() returns the redirect from alias
+// to the page at the root-relative URL to.
+func aliasRedirect(alias string, to string) redirect {
+	from := path.Clean("/" + alias)
+	file := from
+	if strings.HasSuffix(alias, "/") || path.Ext(from) == "" {
+		if strings.HasSuffix(alias, "/") && from != "/" {
+			from += "/"
+		}
+		file = path.Join(file, "index.html")
 	}
-	v, ok := fm[strings.ToLower(key)].([]interface{})
-	if !ok {
-		return []string{}
+	return redirect{From: from, To: to, file: file}
+}
+
+// pageFile() returns the root-relative path in the
+// webroot of the page at the root-relative URL link.
+func pageFile(link string) string {
+	if strings.HasSuffix(link, "/") {
+		return link + "index.html"
 	}
-	s := make([]string, len(v))
-	for i, value := range v {
-		r := fmt.Sprintf("%s", value)
-		s[i] = r
+	return link
+}
+
+// redirects() returns a redirect for every alias in c.pages,
+// sorted by alias. It's an error for an alias to be the URL
+// of a page or for two pages to claim the same alias.
+func (c *config) redirects() ([]redirect, error) {
+	pages := map[string]string{}
+	for _, p := range c.pages {
+		pages[pageFile(p.url)] = p.filename
+	}
+	claimed := map[string]string{}
+	list := []redirect{}
+	for _, p := range c.pages {
+		for _, alias := range fmStrSlice("aliases", p.fm) {
+			r := aliasRedirect(alias, p.url)
+			if other, ok := pages[r.file]; ok {
+				return nil, fmt.Errorf("alias %s in %s is the URL of %s", alias, p.filename, other)
+			}
+			if other, ok := claimed[r.file]; ok {
+				return nil, fmt.Errorf("alias %s in %s is also an alias in %s", alias, p.filename, other)
+			}
+			claimed[r.file] = p.filename
+			list = append(list, r)
+		}
 	}
-	return s
+	sort.Slice(list, func(i, j int) bool { return list[i].From < list[j].From })
+	return list, nil
 }
 
-// themeDirContents() returns a list of all installed themes
-// separated by newlines
-func (c *config) themeDirContents() string {
-	files, err := ioutil.ReadDir(filepath.Join(pocoDir, "themes"))
-	if err != nil {
+// redirectPage() returns the HTML page published at
+// an alias, which sends visitors on to to.
+func redirectPage(to string) string {
+	to = htmlstd.EscapeString(to)
+	return "<!DOCTYPE html>\n<html>\n<head>\n" +
+		"\t<meta charset=\"utf-8\">\n" +
+		"\t<title>Redirecting to " + to + "</title>\n" +
+		"\t<link rel=\"canonical\" href=\"" + to + "\">\n" +
+		"\t<meta name=\"robots\" content=\"noindex\">\n" +
+		"\t<meta http-equiv=\"refresh\" content=\"0; url=" + to + "\">\n" +
+		"</head>\n<body>\n" +
+		"\t<p>This page has moved to <a href=\"" + to + "\">" + to + "</a>.</p>\n" +
+		"</body>\n</html>\n"
+}
+
+// redirectRules() returns the redirects in list
+// in the server configuration format named.
+func redirectRules(format string, list []redirect) string {
+	rules := ""
+	for _, r := range list {
+		switch format {
+		case "netlify":
+			rules += fmt.Sprintf("%s %s 301\n", r.From, r.To)
+		case "nginx":
+			rules += fmt.Sprintf("location = %s { return 301 %s; }\n", r.From, r.To)
+		case "apache":
+			rules += fmt.Sprintf("Redirect 301 %s %s\n", r.From, r.To)
+		}
+	}
+	return rules
+}
+
+// Comments around the rules Poco adds to a server
+// configuration file, so a later build can tell them
+// from the project's own rules
+const redirectRulesStart = "# Redirects for aliases, added by PocoCMS"
+const redirectRulesEnd = "# End of redirects added by PocoCMS"
+
+// redirectSource() returns the old URL redirected by line,
+// a rule from a server configuration file in format, or ""
+// if the line isn't a simple redirect.
+func redirectSource(format, line string) string {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) < 2 || strings.HasPrefix(fields[0], "#"):
 		return ""
+	case format == "netlify":
+		// /old /new 301
+		return fields[0]
+	case format == "nginx" && fields[0] == "location":
+		// location = /old { return 301 /new; }
+		if fields[1] == "=" && len(fields) > 2 {
+			return fields[2]
+		}
+		return fields[1]
+	case format == "apache" && strings.EqualFold(fields[0], "Redirect") && len(fields) > 2:
+		// Redirect 301 /old /new
+		return fields[len(fields)-2]
 	}
+	return ""
+}
 
-	// Return value: the list of files
-	var s string
-	for _, f := range files {
-		file := f.Name()
-		s = s + fmt.Sprintf("%s\n", file)
+// mergeRedirectRules() adds the rules for list in format
+// to existing, the contents of a server configuration file
+// the project already has, replacing any rules an earlier
+// build added. Returns an error if existing already
+// redirects one of the aliases.
+func mergeRedirectRules(existing, format string, list []redirect) (string, error) {
+	if start := strings.Index(existing, redirectRulesStart); start >= 0 {
+		end := strings.Index(existing[start:], redirectRulesEnd)
+		if end < 0 {
+			return "", fmt.Errorf("%q has no matching %q", redirectRulesStart, redirectRulesEnd)
+		}
+		existing = existing[:start] + strings.TrimPrefix(existing[start+end+len(redirectRulesEnd):], "\n")
+	}
+	for _, line := range strings.Split(existing, "\n") {
+		from := redirectSource(format, line)
+		for _, r := range list {
+			if from != "" && from == r.From {
+				return "", fmt.Errorf("alias %s is already redirected by %q", r.From, strings.TrimSpace(line))
+			}
+		}
+	}
+	if existing != "" && !strings.HasSuffix(existing, "\n") {
+		existing += "\n"
+	}
+	return existing + redirectRulesStart + "\n" + redirectRules(format, list) + redirectRulesEnd + "\n", nil
+}
+
+// writeRedirects() publishes a redirect page for every
+// alias, plus the server configuration files named by
+// redirects: on the home page. If the project has its own
+// copy of one of those files, the rules are added to it.
+// Quits if an alias would replace a page or asset, or
+// is already redirected by the project's rules.
+func (c *config) writeRedirects() {
+	list, err := c.redirects()
+	if err != nil {
+		quit(1, err, c, "Unable to create redirects")
+	}
+	for _, r := range list {
+		target := filepath.Join(c.webroot, filepath.FromSlash(r.file))
+		if fileExists(target) {
+			quit(1, nil, c, "Alias %s would replace %s", r.From, r.file)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			quit(1, err, c, "Unable to create directory %s", filepath.Dir(target))
+		}
+		stringToFile(c, target, redirectPage(c.absURL(r.To)))
+	}
+	for _, format := range fmStrSlice("redirects", c.globalFm) {
+		filename, ok := redirectFiles[format]
+		if !ok {
+			quit(1, nil, c, "redirects: must be netlify, nginx, or apache, not %s", format)
+		}
+		if len(list) == 0 {
+			continue
+		}
+		target := filepath.Join(c.webroot, filename)
+		existing := ""
+		if fileExists(target) {
+			existing = c.fileToString(target)
+		}
+		rules, err := mergeRedirectRules(existing, format, list)
+		if err != nil {
+			quit(1, err, c, "Unable to add redirects to %s", filename)
+		}
+		stringToFile(c, target, rules)
 	}
-	return s
 }
 
 // TEMPLATE FUNCTION UTILITIES
 func (c *config) addTemplateFunctions() {
 	c.funcs = template.FuncMap{
-		"ftime": c.ftime,
+		"ftime":     c.ftime,
+		"menu":      c.menuHTML,
+		"menuitems": c.menuItems,
+		"toc":       c.tocHTML,
+		"search":    c.searchHTML,
+		// Search results container for the search page
+		"searchresults": c.searchResultsHTML,
+		// Multilingual sites
+		"i18n":         c.translate,
+		"languages":    c.languageLinks,
+		"languagemenu": c.languageMenuHTML,
+		// Breadcrumbs and prev/next links within a section
+		"breadcrumbs":    c.breadcrumbItems,
+		"breadcrumbmenu": c.breadcrumbMenuHTML,
+		"prevpage":       c.prevPage,
+		"nextpage":       c.nextPage,
+		"pagenav":        c.pageNavHTML,
+		// Last change to the page
+		"lastmod": c.lastmod,
+		"gitinfo": c.gitInfoFor,
 	}
 }
 
@@ -5,10 +5,20 @@ package main
 import (
 	//"regexp"
 	//"fmt"
+	"bytes"
 	"golang.org/x/exp/slices"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 // ********************************************************
@@ -138,6 +148,67 @@ func TestAllFmSlices(t *testing.T) {
 	}
 }
 
+// ********************************************************
+// FRONT MATTER KEYS THAT RETURN LISTS OF KEY/VALUE PAIRS
+// ********************************************************
+
+var fmRegions = `---
+regions:
+  - name: hero
+    tag: section
+  - Name: cta
+    position: after
+---
+`
+
+// TestFmMapSlice tests lists of maps in front matter,
+// such as a theme's regions.
+func TestFmMapSlice(t *testing.T) {
+	var err error
+	var fm map[string]interface{}
+	if _, fm, err = mdYAMLToHTML([]byte(fmRegions)); err != nil {
+		t.Errorf("Unable to get front matter from %s", fmRegions)
+	}
+	list := fmMapSlice("regions", fm)
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 regions. Got %v", list)
+	}
+	if list[0]["name"] != "hero" || list[0]["tag"] != "section" {
+		t.Errorf("First region should be a hero section. Got %v", list[0])
+	}
+	// Keys are forced to lowercase
+	if list[1]["name"] != "cta" || list[1]["position"] != "after" {
+		t.Errorf("Second region should be cta after the article. Got %v", list[1])
+	}
+}
+
+// fmKeyRe matches the front matter keys main.go reads
+// with the fm helpers, such as fmStr("title", c.pageFm)
+var fmKeyRe = regexp.MustCompile(`(?:fm\w*|siteSetting|copyFileSlice|level)\("([a-z]+)"`)
+
+// TestRegionNames makes sure region names can't clash with
+// front matter keys, since a page overrides a region
+// with a key named after it.
+func TestRegionNames(t *testing.T) {
+	for _, name := range []string{"header", "menu", "toc", "title", "search", "theme", "layout", "math", "images"} {
+		if !slices.Contains(frontMatterKeys, name) {
+			t.Errorf("Expected region name %s to be reserved", name)
+		}
+	}
+	if slices.Contains(frontMatterKeys, "hero") {
+		t.Errorf("Expected region name hero to be allowed")
+	}
+	source, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range fmKeyRe.FindAllStringSubmatch(string(source), -1) {
+		if !slices.Contains(frontMatterKeys, m[1]) {
+			t.Errorf("Front matter key %s is missing from frontMatterKeys", m[1])
+		}
+	}
+}
+
 // ********************************************************
 // RAW HTML OUTPUT WITH DEFAULT SETTINGS
 // ********************************************************
@@ -164,6 +235,54 @@ var articleMdToHTMLTests = []struct {
 		// Expected output portion
 		`<h1 id="hello">hello</h1>`,
 	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		"> [!TIP]\n> hello",
+		// Expected output portion
+		"<div class=\"callout-poco callout-tip\" role=\"note\">\n<p class=\"callout-title-poco\">Tip</p>\n<p>hello</p>\n</div>",
+	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		":::warning Careful\nhello\n:::",
+		// Expected output portion
+		"<div class=\"callout-poco callout-warning\" role=\"note\">\n<p class=\"callout-title-poco\">Careful</p>\n<p>hello</p>\n</div>",
+	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		"---\nmath: true\n---\nArea $\\pi r^2$ costs $5 or $10",
+		// Expected output portion
+		`<p>Area <span class="math-poco">\pi r^2</span> costs $5 or $10</p>`,
+	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		"---\nmath: true\n---\n$$\na < b\n$$",
+		// Expected output portion
+		"<div class=\"math-poco math-display\">a &lt; b\n</div>",
+	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		"```mermaid\ngraph TD;\n  A-->B;\n```",
+		// Expected output portion
+		"<pre class=\"mermaid diagram-poco\">graph TD;\n  A--&gt;B;\n</pre>",
+	},
+
+	// TEST RECORD
+	{
+		// Markdown portion
+		"Without math: true, $x$ is text",
+		// Expected output portion
+		"<p>Without math: true, $x$ is text</p>",
+	},
 }
 
 // testArticleCode takes markup and generates the raw HTML for
@@ -205,6 +324,1098 @@ func TestMissingTitleTag(t *testing.T) {
 	}
 }
 
+// ********************************************************
+// LAYOUT TEMPLATES
+// ********************************************************
+
+// TestExecuteLayout makes sure a theme layout receives
+// the rendered pieces unescaped and page data escaped.
+func TestExecuteLayout(t *testing.T) {
+	c := newConfig()
+	layout := `<body class="{{.Page.bodyclass}}"><main>{{.Article}}</main></body>`
+	data := layoutData{
+		Article: "<p>hello</p>",
+		Page:    map[string]interface{}{"bodyclass": "a&b"},
+	}
+	actual, err := c.executeLayout(layout, data)
+	if err != nil {
+		t.Fatalf("executeLayout: %v", err)
+	}
+	expected := `<body class="a&amp;b"><main><p>hello</p></main></body>`
+	if actual != expected {
+		t.Errorf("executeLayout(): expected %s. Got %s", expected, actual)
+	}
+}
+
+// ********************************************************
+// SHORTCODES
+// ********************************************************
+
+func TestParseShortcodeParams(t *testing.T) {
+	args, params := parseShortcodeParams(` "Careful now" type="warning" size=big extra`)
+	if !slices.Equal(args, []string{"Careful now", "extra"}) {
+		t.Errorf("Positional parameters: expected [Careful now extra]. Got %v", args)
+	}
+	if params["type"] != "warning" || params["size"] != "big" {
+		t.Errorf("Named parameters: expected type=warning size=big. Got %v", params)
+	}
+}
+
+// Shortcodes inside fenced code blocks, and escaped ones,
+// appear on the page as written.
+func TestProtectShortcodes(t *testing.T) {
+	c := newConfig()
+	c.addTemplateFunctions()
+	source := "Use {{</* callout */>}} like this:\n\n```\n{{< callout >}}Hi{{< /callout >}}\n```\n"
+	b, err := c.expandShortcodes([]byte(source))
+	if err != nil {
+		t.Fatalf("expandShortcodes: %v", err)
+	}
+	html, _, err := mdYAMLToHTML(b)
+	if err != nil {
+		t.Fatalf("mdYAMLToHTML: %v", err)
+	}
+	actual, err := doTemplate("", string(html), c)
+	for _, expected := range []string{
+		"<p>Use {{&lt; callout &gt;}} like this:</p>",
+		"<code>{{&lt; callout &gt;}}Hi{{&lt; /callout &gt;}}",
+	} {
+		if err != nil || !strings.Contains(actual, expected) {
+			t.Errorf("Expected %q in %q, %v", expected, actual, err)
+		}
+	}
+}
+
+func TestKeepInHTMLBlock(t *testing.T) {
+	html := "<div>\n\n<p>Hi</p>\n<pre><code>a\n\n  \nb\n</code></pre>\n\n</div>\n"
+	expected := "<div>\n<p>Hi</p>\n<pre><code>a\n&#10;&#32;&#32;&#10;b\n</code></pre>\n</div>"
+	if actual := keepInHTMLBlock(html); actual != expected {
+		t.Errorf("Expected %q. Got %q", expected, actual)
+	}
+}
+
+// ********************************************************
+// PAGES AND MENUS
+// ********************************************************
+
+func TestParseFrontMatter(t *testing.T) {
+	fm, body := parseFrontMatter([]byte("---\ntitle: Hi\nmenu: main\n---\n# Hi\n"))
+	if fmStr("title", fm) != "Hi" || fmStr("menu", fm) != "main" || string(body) != "# Hi\n" {
+		t.Errorf("Expected title and menu, then # Hi. Got %v, %q", fm, body)
+	}
+	fm, body = parseFrontMatter([]byte("# No front matter\n"))
+	if len(fm) != 0 || string(body) != "# No front matter\n" {
+		t.Errorf("Expected no front matter. Got %v, %q", fm, body)
+	}
+}
+
+// Only calls to Poco's template functions get their quotes back.
+func TestUnescapeActions(t *testing.T) {
+	funcs := map[string]interface{}{"menu": nil}
+	source := `{{ menu &quot;main&quot; }} <code>{{ printf &quot;%d&quot; 1 }}</code>`
+	expected := `{{ menu "main" }} <code>{{ printf &quot;%d&quot; 1 }}</code>`
+	if actual := unescapeActions(source, funcs); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
+
+var pageURLTests = []struct {
+	filename string
+	expected string
+}{
+	{"index.md", "/"},
+	{"README.md", "/"},
+	{"about.md", "/about.html"},
+	{"docs/intro.md", "/docs/intro.html"},
+}
+
+func TestPageURL(t *testing.T) {
+	for _, tt := range pageURLTests {
+		actual := pageURL(tt.filename)
+		if actual != tt.expected {
+			t.Errorf("pageURL(%s): expected %s. Got %s", tt.filename, tt.expected, actual)
+		}
+	}
+}
+
+// Template actions in Markdown files must survive
+// Goldmark's HTML escaping.
+func TestMenuTemplateInMarkdown(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.currentFilename = "/site/about.md"
+	c.menus = map[string][]menuEntry{
+		"main": {{Title: "Home", URL: "/"}, {Title: "About", URL: "/about.html"}},
+	}
+	actual := mdYAMLStringToTemplatedHTMLString(c, "about.md", `{{ menu "main" }}`)
+	expected := `<a href="/about.html" aria-current="page">About</a>`
+	if !strings.Contains(actual, expected) {
+		t.Errorf("Expected menu containing %s. Got %s", expected, actual)
+	}
+}
+
+// ********************************************************
+// INCLUDES
+// ********************************************************
+
+var includeFiles = map[string]string{
+	"partials/install.md": "---\ntitle: Install\n---\nRun the installer.\n{{< include \"partials/note.md\" >}}\n",
+	"partials/note.md":    "Then restart.\n",
+	"src/main.go":         "package main\n\nfunc main() {\n\t// region greet\n\tfmt.Println(\"hi\")\n\t// endregion greet\n}\n",
+	"partials/dashes.md":  "----\ntitle: Dashes\n---\nBody only.\n",
+	"src/braces.go":       "var points = []point{{1, 2}}\n",
+	"loop/a.md":           "{{< include \"loop/b.md\" >}}\n",
+	"loop/b.md":           "{{< include \"loop/a.md\" >}}\n",
+}
+
+var includeTests = []struct {
+	source   string
+	expected string
+}{
+	// TEST RECORD
+	{
+		// Front matter is dropped and nested includes expanded
+		`{{< include "partials/install.md" >}}`,
+		"Run the installer.\nThen restart.",
+	},
+
+	// TEST RECORD
+	{
+		// Front matter can open with any number of dashes
+		`{{< include "partials/dashes.md" >}}`,
+		"Body only.",
+	},
+
+	// TEST RECORD
+	{
+		// Braces in source code are kept from the template engine
+		`{{< code "src/braces.go" >}}`,
+		"```go\nvar points = []point" + literalBraces + "1, 2}}\n```",
+	},
+
+	// TEST RECORD
+	{
+		`{{< code "src/main.go" region="greet" >}}`,
+		"```go\nfmt.Println(\"hi\")\n```",
+	},
+
+	// TEST RECORD
+	{
+		`{{< code "src/main.go" lines="3-" lang="golang" linenos="table" >}}`,
+		"```golang {linenos=table,linenostart=3}\nfunc main() {\n\t// region greet\n\tfmt.Println(\"hi\")\n\t// endregion greet\n}\n```",
+	},
+}
+
+func TestIncludes(t *testing.T) {
+	c := newConfig()
+	c.root = t.TempDir()
+	c.currentFilename = filepath.Join(c.root, "index.md")
+	for name, contents := range includeFiles {
+		filename := filepath.Join(c.root, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range includeTests {
+		actual, err := c.expandShortcodes([]byte(tt.source))
+		if err != nil {
+			t.Errorf("%s: %v", tt.source, err)
+		} else if string(actual) != tt.expected {
+			t.Errorf("%s: expected %q. Got %q", tt.source, tt.expected, actual)
+		}
+	}
+	// The page's templates run without tripping over the braces
+	b, _ := c.expandShortcodes([]byte(`{{< code "src/braces.go" >}}`))
+	HTML, _, _ := mdYAMLToHTML(b)
+	if page, err := doTemplate("", string(HTML), c); err != nil || !strings.Contains(page, "{{") || strings.Contains(page, literalBraces) {
+		t.Errorf("Expected {{ in the code. Got %q (%v)", page, err)
+	}
+	expected := []string{"partials/install.md", "partials/note.md", "partials/dashes.md", "src/braces.go", "src/main.go"}
+	if !slices.Equal(c.dependencies[c.currentFilename], expected) {
+		t.Errorf("Expected dependencies %v. Got %v", expected, c.dependencies[c.currentFilename])
+	}
+	// Changing an included file changes the page
+	old, changed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(c.currentFilename, []byte("# Home"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range append([]string{"index.md"}, expected...) {
+		if err := os.Chtimes(filepath.Join(c.root, filename), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(c.root, "partials", "note.md"), changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	if actual := c.pageLastmod("index.md"); !actual.Equal(changed) {
+		t.Errorf("Expected %v from partials/note.md. Got %v", changed, actual)
+	}
+	for _, source := range []string{`{{< include "../secret.md" >}}`, `{{< code file="partials/../../secret.go" >}}`} {
+		if _, err := c.expandShortcodes([]byte(source)); err == nil || !strings.Contains(err.Error(), "outside the project") {
+			t.Errorf("%s: expected an error for a file outside the project. Got %v", source, err)
+		}
+	}
+	_, err := c.expandShortcodes([]byte(`{{< include "loop/a.md" >}}`))
+	if err == nil || !strings.Contains(err.Error(), "include cycle: index.md -> loop/a.md -> loop/b.md -> loop/a.md") {
+		t.Errorf("Expected an include cycle error. Got %v", err)
+	}
+}
+
+// ********************************************************
+// IMAGES
+// ********************************************************
+
+func TestProcessImages(t *testing.T) {
+	c := newConfig()
+	c.root = t.TempDir()
+	c.webroot = filepath.Join(c.root, "WWW")
+	c.currentFilename = filepath.Join(c.root, "docs", "page.md")
+	c.globalFm = map[string]interface{}{
+		"images": map[interface{}]interface{}{"widths": []interface{}{50, 100}},
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 80, 40))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(c.root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.root, "docs", "pic.png"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	actual := c.processImages(`<p><img src="pic.png" alt="Pic" /> <img src="https://example.com/a.png" alt="Remote" /></p>`)
+	expected := `<p><img src="pic.png" alt="Pic" width="80" height="40" loading="lazy" decoding="async" ` +
+		`srcset="pic-50w.png 50w, pic.png 80w" sizes="(max-width: 768px) 100vw, 80vw" /> ` +
+		`<img src="https://example.com/a.png" alt="Remote" /></p>`
+	if actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+	// A resized copy of an image that's since changed
+	cache := filepath.Join(c.root, pocoDir, cacheDir, imageCacheDir)
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(cache, "0123456789abcdef-50w-q80.png")
+	if err := os.WriteFile(stale, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.writeImageVariants()
+	f, err := os.Open(filepath.Join(c.webroot, "docs", "pic-50w.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := png.DecodeConfig(f)
+	if err != nil || config.Width != 50 || config.Height != 25 {
+		t.Errorf("Expected a 50x25 image. Got %dx%d (%v)", config.Width, config.Height, err)
+	}
+	if entries, _ := os.ReadDir(cache); fileExists(stale) || len(entries) != 1 {
+		t.Errorf("Expected only the image used by this build in the cache. Got %v", entries)
+	}
+}
+
+func TestHtmlAttr(t *testing.T) {
+	tag := `<img SRC='a.png' alt="Fish &amp; chips" hidden>`
+	if src, ok := htmlAttr(tag, "src"); !ok || src != "a.png" {
+		t.Errorf("Expected src a.png. Got %q", src)
+	}
+	if alt, _ := htmlAttr(tag, "alt"); alt != "Fish & chips" {
+		t.Errorf("Expected alt Fish & chips. Got %q", alt)
+	}
+	if _, ok := htmlAttr(tag, "hidden"); !ok {
+		t.Errorf("Expected hidden to be present")
+	}
+	if _, ok := htmlAttr(tag, "width"); ok {
+		t.Errorf("Expected width to be missing")
+	}
+}
+
+// ********************************************************
+// SEARCH
+// ********************************************************
+
+func TestSearchIndex(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.globalFm = map[string]interface{}{"search": true}
+	pages := []struct {
+		filename string
+		fm       map[string]interface{}
+	}{
+		{"/site/docs/intro.md", map[string]interface{}{"tags": []interface{}{"start"}}},
+		{"/site/secret.md", map[string]interface{}{"search": false}},
+	}
+	for _, p := range pages {
+		c.currentFilename = p.filename
+		c.pageFm = p.fm
+		c.headings = []heading{{level: 1, title: "Intro"}, {level: 2, title: "Install"}}
+		c.articleParsed = "<h1>Intro</h1>\n<p>Fish &amp; <em>chips</em></p><script>var x;</script>"
+		c.addToSearchIndex()
+	}
+	expected := []searchEntry{{
+		Title:    "Intro",
+		URL:      "/docs/intro.html",
+		Headings: []string{"Install"},
+		Text:     "Intro Fish & chips",
+		Tags:     []string{"start"},
+	}}
+	if !reflect.DeepEqual(c.searchIndex, expected) {
+		t.Errorf("Expected %+v. Got %+v", expected, c.searchIndex)
+	}
+}
+
+// ********************************************************
+// TABLE OF CONTENTS
+// ********************************************************
+
+var tocSource = `---
+toc: true
+---
+# Title
+[TOC]
+## Install
+### Linux
+#### Too deep
+## Use
+`
+
+func TestTOC(t *testing.T) {
+	c := newConfig()
+	var err error
+	var HTML []byte
+	if HTML, c.pageFm, c.headings, err = mdYAMLToHTMLWithHeadings([]byte(tocSource), nil); err != nil {
+		t.Fatalf("Unable to convert %s", tocSource)
+	}
+	tree := c.tocTree()
+	if len(tree) != 2 || tree[0].ID != "install" || tree[1].ID != "use" {
+		t.Fatalf("Expected Install and Use at top level. Got %v", tree)
+	}
+	if len(tree[0].Children) != 1 || tree[0].Children[0].Title != "Linux" {
+		t.Errorf("Expected Linux under Install. Got %v", tree[0].Children)
+	}
+	article := c.insertTOC(string(HTML))
+	if strings.Contains(article, "[TOC]") || !strings.Contains(article, `<a href="#use">Use</a>`) {
+		t.Errorf("[TOC] should be replaced by the table of contents. Got %s", article)
+	}
+}
+
+// ********************************************************
+// DIAGRAMS
+// ********************************************************
+
+var diagramSource = `---
+diagrams:
+  dot: cat
+---
+` + "```dot\n<svg>a -> b</svg>\n```\n```plantuml\nA -> B\n```\n"
+
+func TestRenderDiagrams(t *testing.T) {
+	c := newConfig()
+	var err error
+	var HTML []byte
+	if HTML, c.pageFm, err = mdYAMLToHTML([]byte(diagramSource)); err != nil {
+		t.Fatalf("Unable to convert %s", diagramSource)
+	}
+	// Only the home page can name diagram commands
+	if actual := c.renderDiagrams(string(HTML)); actual != string(HTML) {
+		t.Errorf("Expected a page's own diagrams: to be ignored. Got %q", actual)
+	}
+	c.globalFm = c.pageFm
+	// cat echoes the diagram source back as its "SVG".
+	// plantuml has no command, so its source stays put.
+	actual := c.renderDiagrams(string(HTML))
+	expected := "<div class=\"diagram-poco diagram-dot\"><svg>a -> b</svg></div>\n" +
+		"<pre class=\"diagram-poco diagram-plantuml\">A -&gt; B\n</pre>\n"
+	if actual != expected {
+		t.Errorf("Expected %q. Got %q", expected, actual)
+	}
+	// A Mermaid diagram in the footer still needs the script
+	mermaid := "<pre class=\"mermaid diagram-poco\">graph TD;\n  A--&gt;B;\n</pre>\n"
+	c.theme.present, c.theme.footer = true, mermaid
+	if !c.hasMermaid() {
+		t.Errorf("Expected the Mermaid diagram in the footer to be found")
+	}
+	// Unless a command renders Mermaid diagrams itself
+	c.globalFm["diagrams"] = map[interface{}]interface{}{"mermaid": "cat"}
+	expected = "<div class=\"diagram-poco diagram-mermaid\">graph TD;\n  A-->B;</div>"
+	if actual := c.renderDiagrams(mermaid); !strings.HasPrefix(actual, expected) {
+		t.Errorf("Expected %q. Got %q", expected, actual)
+	}
+}
+
+// ********************************************************
+// SYNTAX HIGHLIGHTING
+// ********************************************************
+
+var highlightSource = "```go {hl_lines=[2]}\npackage main\nfunc main() {}\n```\n"
+
+func TestHighlightClasses(t *testing.T) {
+	c := newConfig()
+	var err error
+	var HTML []byte
+	c.pageFm = map[string]interface{}{
+		"highlight": map[interface{}]interface{}{"style": "github", "dark": "dracula", "classes": true},
+	}
+	if HTML, _, _, err = mdYAMLToHTMLWithHeadings([]byte(highlightSource), nil, c.highlightOptions()...); err != nil {
+		t.Fatalf("Unable to convert %s", highlightSource)
+	}
+	c.articleRawHTML = string(HTML)
+	if strings.Contains(c.articleRawHTML, "style=") || !strings.Contains(c.articleRawHTML, `class="line hl"`) {
+		t.Errorf("Expected classes and a highlighted line instead of inline styles. Got %s", c.articleRawHTML)
+	}
+	css := c.highlightCSS()
+	if !strings.Contains(css, ".chroma .k {") || !strings.Contains(css, "@media (prefers-color-scheme:dark){") {
+		t.Errorf("Expected light and dark stylesheets. Got %s", css)
+	}
+	// Code in a page layout element needs the stylesheet too
+	c.theme.present, c.theme.footer, c.articleRawHTML = true, c.articleRawHTML, ""
+	if c.highlightCSS() != css {
+		t.Errorf("Expected the stylesheet for code in the footer")
+	}
+}
+
+// ********************************************************
+// MINIFY
+// ********************************************************
+
+func TestMinifyString(t *testing.T) {
+	c := newConfig()
+	page := "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<style>\n/* Comment */\nbody {\n  color: red;\n}\n</style>\n</head>\n" +
+		"<body>\n<!-- Comment -->\n<p>Hello,   world</p>\n<pre>a\n  b</pre>\n<script>\n// Comment\nvar x = 1;\n</script>\n</body>\n</html>\n"
+	if actual := c.minifyString("text/html", "page.html", page); actual != page {
+		t.Errorf("Expected page unchanged without -minify. Got %s", actual)
+	}
+	c.minifyFlag = true
+	expected := `<!doctype html><html lang=en><head><style>body{color:red}</style></head>` +
+		"<body><p>Hello, world</p><pre>a\n  b</pre><script>var x=1</script></body></html>"
+	if actual := c.minifyString("text/html", "page.html", page); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+	if c.minified.files != 1 || c.minified.before != len(page) || c.minified.after != len(expected) {
+		t.Errorf("Expected 1 file from %d to %d bytes. Got %+v", len(page), len(expected), c.minified)
+	}
+}
+
+// ********************************************************
+// STYLESHEET BUNDLES
+// ********************************************************
+
+func TestBundledStylesheets(t *testing.T) {
+	c := newConfig()
+	c.root = t.TempDir()
+	c.webroot = filepath.Join(c.root, "WWW")
+	c.bundleStylesFlag = true
+	c.theme = theme{present: true, name: "clerk", dir: filepath.Join(pocoDir, "themes", "clerk"),
+		stylesheetFilenames: []string{"clerk.css"}}
+	themeDir := filepath.Join(c.root, c.theme.dir)
+	if err := os.MkdirAll(filepath.Join(themeDir, "fonts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	css := "body{background:url('fonts/bg.png?v=2') url(data:x) url(https://example.com/a.png)}"
+	if err := os.WriteFile(filepath.Join(themeDir, "clerk.css"), []byte(css), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(themeDir, "fonts", "bg.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := c.bundledStylesheets(c.root)
+	if link != c.bundledStylesheets(c.root) || len(c.bundles) != 1 {
+		t.Fatalf("Expected pages with the same stylesheets to share one bundle. Got %v", c.bundles)
+	}
+	c.writeBundles()
+	files, _ := filepath.Glob(filepath.Join(c.webroot, assetsDir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected a bundle and one asset. Got %v", files)
+	}
+	bg := "bg." + hashBytes([]byte("png"))[:8] + ".png"
+	bundle := "clerk." + hashBytes([]byte("\n/* clerk.css*/\n" +
+		`body{background:url("` + bg + `?v=2") url(data:x) url(https://example.com/a.png)}` + "\n"))[:8] + ".css"
+	expected := `<link rel="stylesheet" href="/assets/` + bundle + "\">\n"
+	if link != expected {
+		t.Errorf("Expected %s. Got %s", expected, link)
+	}
+	if !fileExists(filepath.Join(c.webroot, assetsDir, bg)) {
+		t.Errorf("Expected %s to be published", bg)
+	}
+}
+
+// ********************************************************
+// DOWNLOADS
+// ********************************************************
+
+func TestFetch(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/missing.css" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("body{color:red}"))
+	}))
+	defer server.Close()
+	c := newConfig()
+	c.root = t.TempDir()
+	for i := 0; i < 2; i++ {
+		if s, err := c.fetch(server.URL + "/a.css"); err != nil || s != "body{color:red}" {
+			t.Fatalf("Expected stylesheet. Got %q (%v)", s, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected one download per build. Got %d", requests)
+	}
+	if _, err := c.fetch(server.URL + "/missing.css"); err == nil {
+		t.Errorf("Expected an error for a 404 response")
+	}
+
+	// A later build revalidates its cached copy.
+	root := c.root
+	c = newConfig()
+	c.root = root
+	requests = 0
+	if s, err := c.fetch(server.URL + "/a.css"); err != nil || s != "body{color:red}" || requests != 1 {
+		t.Errorf("Expected cached stylesheet after revalidating. Got %q (%v) after %d requests", s, err, requests)
+	}
+
+	// Offline builds only use the cache.
+	offline := newConfig()
+	offline.root = c.root
+	offline.offlineFlag = true
+	server.Close()
+	if s, err := offline.fetch(server.URL + "/a.css"); err != nil || s != "body{color:red}" {
+		t.Errorf("Expected cached stylesheet offline. Got %q (%v)", s, err)
+	}
+	if _, err := offline.fetch(server.URL + "/b.css"); err == nil {
+		t.Errorf("Expected an error offline without a cached copy")
+	}
+}
+
+var remoteFiles = map[string]string{
+	"/css/main.css":  "@import url(\"fonts.css\") screen;\n@import \"loop.css\";\nbody{background:url(img/bg.png)}",
+	"/css/fonts.css": "h1{font-family:serif}",
+	"/css/loop.css":  "@import \"main.css\";\np{margin:0}",
+	"/js/app.js":     "console.log(1)",
+}
+
+// TestRemoteImportsAndScripts makes sure stylesheets imported
+// by remote stylesheets, and remote scripts, are downloaded
+// and cached like remote stylesheets.
+func TestRemoteImportsAndScripts(t *testing.T) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		w.Write([]byte(remoteFiles[r.URL.Path]))
+	}))
+	defer server.Close()
+	c := newConfig()
+	c.root = t.TempDir()
+	sheet := server.URL + "/css/main.css"
+	expected := "\n/* " + server.URL + "/css/fonts.css */\n@media screen {\nh1{font-family:serif}\n}\n\n" +
+		"\n/* " + server.URL + "/css/loop.css */\n\np{margin:0}\n\n" +
+		"body{background:url(\"" + server.URL + "/css/img/bg.png\")}"
+	for i := 0; i < 2; i++ {
+		if actual := c.stylesheetStr(sheet); actual != expected {
+			t.Fatalf("Expected %q. Got %q", expected, actual)
+		}
+	}
+	c.fm = map[string]interface{}{"endjs": []interface{}{server.URL + "/js/app.js"}}
+	if actual := c.copyFileSlice("endjs", ""); actual != "console.log(1)" {
+		t.Errorf("Expected the remote script. Got %q", actual)
+	}
+	for path, n := range requests {
+		if n != 1 {
+			t.Errorf("Expected one download of %s. Got %d", path, n)
+		}
+	}
+
+	// Imports and scripts come from the cache offline
+	offline := newConfig()
+	offline.root = c.root
+	offline.offlineFlag = true
+	offline.fm = c.fm
+	server.Close()
+	if actual := offline.stylesheetStr(sheet); actual != expected {
+		t.Errorf("Expected %q offline. Got %q", expected, actual)
+	}
+	if actual := offline.copyFileSlice("endjs", ""); actual != "console.log(1)" {
+		t.Errorf("Expected the cached script offline. Got %q", actual)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body{color:red}"))
+	}))
+	defer server.Close()
+	c := newConfig()
+	c.root = t.TempDir()
+	hash := sri("sha384", []byte("body{color:red}"))
+	tags := `<link rel="stylesheet" href="` + server.URL + `/a.css">` +
+		`<link rel="preconnect" href="` + server.URL + `">` +
+		`<script src="` + server.URL + `/a.js"></script><link rel="stylesheet" href="local.css"/>`
+	expected := `<link rel="stylesheet" href="` + server.URL + `/a.css" integrity="` + hash + `" crossorigin="anonymous">` +
+		`<link rel="preconnect" href="` + server.URL + `">` +
+		`<script src="` + server.URL + `/a.js" integrity="` + hash + `" crossorigin="anonymous"></script><link rel="stylesheet" href="local.css"/>`
+	if actual := c.addIntegrity(tags); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+
+	c = newConfig()
+	c.root = t.TempDir()
+	c.globalFm = map[string]interface{}{
+		"integrity": map[interface{}]interface{}{server.URL + "/a.css": sri("sha256", []byte("body{color:blue}"))},
+	}
+	if _, err := c.fetch(server.URL + "/a.css"); err == nil {
+		t.Errorf("Expected a hash mismatch")
+	}
+
+	// Hashes saved by -lock are checked too
+	c = newConfig()
+	c.root = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(c.root, pocoDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lock := `{"` + server.URL + `/a.css": "` + sri("sha384", []byte("body{color:blue}")) + `"}`
+	if err := os.WriteFile(filepath.Join(c.root, pocoDir, integrityLock), []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.fetch(server.URL + "/a.css"); err == nil || !strings.Contains(err.Error(), "expected hash") {
+		t.Errorf("Expected a hash mismatch with %s. Got %v", integrityLock, err)
+	}
+	c.globalFm = map[string]interface{}{}
+	c.globalFm["remotehosts"] = []interface{}{"*.example.com"}
+	if _, err := c.fetch(server.URL + "/b.css"); err == nil {
+		t.Errorf("Expected %s to be refused", server.URL)
+	}
+	c.globalFm["remotehosts"] = []interface{}{"127.0.0.1"}
+	if _, err := c.fetch(server.URL + "/b.css"); err != nil {
+		t.Errorf("Expected %s to be allowed. Got %v", server.URL, err)
+	}
+}
+
+// ********************************************************
+// CONTENT SECURITY POLICY
+// ********************************************************
+
+func TestAddCSP(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.currentFilename = "/site/docs/page.md"
+	c.csp = "both"
+	c.globalFm = map[string]interface{}{
+		"csp": map[interface{}]interface{}{"connect-src": "'self' https://api.example.com"},
+	}
+	page := "<html><head><style>p{color:red}</style></head><body>" +
+		`<p style="color:blue">Hi</p><iframe src="https://www.youtube.com/embed/x"></iframe>` +
+		`<script src="https://cdn.example.com/a.js"></script><script>import('https://cdn.jsdelivr.net/m.mjs')</script></body></html>`
+	policy := "default-src 'self'; " +
+		"script-src 'self' '" + sri("sha256", []byte("import('https://cdn.jsdelivr.net/m.mjs')")) + "' https://cdn.jsdelivr.net https://cdn.example.com; " +
+		"style-src 'self' '" + sri("sha256", []byte("p{color:red}")) + "' 'unsafe-hashes' '" + sri("sha256", []byte("color:blue")) + "'; " +
+		"img-src 'self' data:; frame-src https://www.youtube.com; object-src 'none'; base-uri 'self'; " +
+		"connect-src 'self' https://api.example.com"
+	actual := c.addCSP(page)
+	expected := `<html><head><meta http-equiv="Content-Security-Policy" content="` +
+		strings.ReplaceAll(policy, "'", "&#39;") + `">` + page[len("<html><head>"):]
+	if actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+	if c.cspPolicies["/docs/page.html"] != policy {
+		t.Errorf("Expected header policy %s. Got %s", policy, c.cspPolicies["/docs/page.html"])
+	}
+}
+
+// ********************************************************
+// SAFE HTML
+// ********************************************************
+
+var safeHTMLSource = `Hi <span class="x" onclick="steal()">there</span> <a href="javascript:alert(1)">link</a>
+
+<div title="ok"><script>alert(1)</script><iframe src="https://example.com"></iframe></div>
+`
+
+func TestSafeHTML(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.globalFm = map[string]interface{}{"safehtml": "sanitize"}
+	safe := c.safeHTML()
+	HTML, _, _, err := mdYAMLToHTMLWithHeadings([]byte(safeHTMLSource), safe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<p>Hi <span class="x">there</span> <a>link</a></p>` + "\n" + `<div title="ok"></div>` + "\n"
+	if string(HTML) != expected {
+		t.Errorf("Expected %s. Got %s", expected, HTML)
+	}
+	violations := []string{
+		"removed onclick attribute from <span>",
+		`removed href="javascript:alert(1)" from <a>`,
+		"removed <script> tag",
+		"removed <iframe> tag",
+	}
+	if !reflect.DeepEqual(safe.violations, violations) {
+		t.Errorf("Expected violations %v. Got %v", violations, safe.violations)
+	}
+
+	// A page can be stricter than the site, but not looser.
+	c.pageFm = map[string]interface{}{"safehtml": "strip"}
+	if safe = c.safeHTML(); safe == nil || !safe.strip {
+		t.Errorf("Expected strip mode")
+	}
+	HTML, _, _, _ = mdYAMLToHTMLWithHeadings([]byte(safeHTMLSource), safe)
+	if string(HTML) != "<p>Hi there link</p>\n" {
+		t.Errorf("Expected raw HTML to be removed. Got %s", HTML)
+	}
+	c.pageFm = map[string]interface{}{"safehtml": "false"}
+	if safe = c.safeHTML(); safe == nil || safe.strip {
+		t.Errorf("Expected the site's sanitize mode")
+	}
+}
+
+func TestSafeURLs(t *testing.T) {
+	c := newConfig()
+	c.globalFm = map[string]interface{}{"safehtml": "sanitize"}
+	safe := c.safeHTML()
+	source := "[x](javascript:alert(1)) ![i](javascript:alert(2)) <javascript:alert(3)> [ok](https://example.com)\n"
+	HTML, _, _, err := mdYAMLToHTMLWithHeadings([]byte(source), safe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<p>x i javascript:alert(3) <a href="https://example.com">ok</a></p>` + "\n"
+	if string(HTML) != expected {
+		t.Errorf("Expected %s. Got %s", expected, HTML)
+	}
+	violations := []string{
+		`removed link to "javascript:alert(1)"`,
+		`removed image "javascript:alert(2)"`,
+		`removed link to "javascript:alert(3)"`,
+	}
+	if !reflect.DeepEqual(safe.violations, violations) {
+		t.Errorf("Expected violations %v. Got %v", violations, safe.violations)
+	}
+}
+
+// ********************************************************
+// SOCIAL AND SEARCH ENGINE METADATA
+// ********************************************************
+
+func TestSocialMetadata(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.homePage = "/site/index.md"
+	c.currentFilename = "/site/docs/install.md"
+	c.globalFm = map[string]interface{}{
+		"baseurl": "https://example.com/", "sitename": "Example",
+		"image": "/card.png", "author": "Pat", "twitter": "@ex",
+	}
+	c.pageFm = map[string]interface{}{
+		"title": "Install", "image": "shot.png",
+		"date": time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "schematype": "BlogPosting",
+	}
+	c.pages = []pageInfo{
+		{filename: "index.md", key: "index.md", url: "/", fm: c.globalFm},
+		{filename: "docs/index.md", key: "docs/index.md", url: "/docs/index.html", fm: map[string]interface{}{"title": "Docs"}},
+	}
+	if actual, expected := c.canonicalTag(), "\t<link rel=\"canonical\" href=\"https://example.com/docs/install.html\">\n"; actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+	tags := c.socialTags()
+	for _, tag := range []string{
+		`<meta property="og:title" content="Install">`,
+		`<meta property="og:type" content="article">`,
+		`<meta property="og:image" content="https://example.com/docs/shot.png">`,
+		`<meta property="article:published_time" content="2024-05-01">`,
+		`<meta name="twitter:card" content="summary_large_image">`,
+	} {
+		if !strings.Contains(tags, tag) {
+			t.Errorf("Expected %s in %s", tag, tags)
+		}
+	}
+	expected := "\t<script type=\"application/ld+json\">" +
+		`{"@context":"https://schema.org","@type":"BlogPosting","author":{"@type":"Person","name":"Pat"},` +
+		`"datePublished":"2024-05-01","headline":"Install","image":"https://example.com/docs/shot.png",` +
+		`"url":"https://example.com/docs/install.html"}</script>` + "\n" +
+		"\t<script type=\"application/ld+json\">" +
+		`{"@context":"https://schema.org","@type":"BreadcrumbList","itemListElement":[` +
+		`{"@type":"ListItem","item":"https://example.com/","name":"Example","position":1},` +
+		`{"@type":"ListItem","item":"https://example.com/docs/index.html","name":"Docs","position":2},` +
+		`{"@type":"ListItem","item":"https://example.com/docs/install.html","name":"Install","position":3}]}</script>` + "\n"
+	if actual := c.jsonLD(); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
+
+// ********************************************************
+// MULTILINGUAL SITES
+// ********************************************************
+
+func TestMultilingual(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.markdownExtensions.list = []string{".md"}
+	c.languages = []string{"en", "fr"}
+	c.translations = map[string]map[string]string{
+		"en": {"hello": "Hello", "bye": "Goodbye"},
+		"fr": {"hello": "Bonjour", "languagename": "Français"},
+	}
+	c.globalFm = map[string]interface{}{"baseurl": "https://example.com"}
+	for _, tt := range []struct{ rel, lang, key, langPath string }{
+		{"docs/intro.md", "en", "docs/intro.md", "docs/intro.md"},
+		{"docs/intro.fr.md", "fr", "docs/intro.md", "fr/docs/intro.md"},
+		{"content/fr/docs/intro.md", "fr", "docs/intro.md", "fr/docs/intro.md"},
+		{"content/en/about.md", "en", "about.md", "about.md"},
+		{"content/fr/logo.png", "fr", "logo.png", "fr/logo.png"},
+		{"style.de.md", "en", "style.de.md", "style.de.md"},
+	} {
+		lang, key := c.langOf(tt.rel)
+		if lang != tt.lang || key != tt.key || c.langPath(tt.rel) != tt.langPath {
+			t.Errorf("%s: expected %s, %s, %s. Got %s, %s, %s", tt.rel, tt.lang, tt.key, tt.langPath, lang, key, c.langPath(tt.rel))
+		}
+	}
+	for _, rel := range []string{"index.md", "docs/intro.md", "content/fr/docs/intro.md"} {
+		lang, key := c.langOf(rel)
+		c.pages = append(c.pages, pageInfo{filename: rel, url: pageURL(c.langPath(rel)), lang: lang, key: key})
+	}
+	c.currentFilename = "/site/content/fr/docs/intro.md"
+	if c.translate("hello") != "Bonjour" || c.translate("bye") != "Goodbye" || c.translate("none") != "none" {
+		t.Errorf("Expected French, then English, then the key")
+	}
+	expected := []languageLink{
+		{Code: "en", Name: "en", URL: "/docs/intro.html"},
+		{Code: "fr", Name: "Français", URL: "/fr/docs/intro.html", Current: true},
+	}
+	if actual := c.languageLinks(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v. Got %v", expected, actual)
+	}
+	tags := "\t<link rel=\"alternate\" hreflang=\"en\" href=\"https://example.com/docs/intro.html\">\n" +
+		"\t<link rel=\"alternate\" hreflang=\"fr\" href=\"https://example.com/fr/docs/intro.html\">\n" +
+		"\t<link rel=\"alternate\" hreflang=\"x-default\" href=\"https://example.com/docs/intro.html\">\n"
+	if actual := c.hreflangTags(); actual != tags {
+		t.Errorf("Expected %s. Got %s", tags, actual)
+	}
+}
+
+// ********************************************************
+// SECTIONS
+// ********************************************************
+
+func TestSectionNavigation(t *testing.T) {
+	c := newConfig()
+	c.root = "/site"
+	c.globalFm = map[string]interface{}{"sitename": "Example"}
+	page := func(filename string, fm map[string]interface{}) pageInfo {
+		return pageInfo{filename: filename, key: filename, url: pageURL(filename), fm: fm}
+	}
+	c.pages = []pageInfo{
+		page("index.md", c.globalFm),
+		page("docs/index.md", map[string]interface{}{"title": "Docs"}),
+		page("docs/setup/README.md", map[string]interface{}{"title": "Setup", "menutitle": "Set up"}),
+		page("docs/setup/install.md", map[string]interface{}{"title": "Install", "weight": 1}),
+		page("docs/setup/configure.md", map[string]interface{}{"title": "Configure", "weight": 2}),
+		page("docs/setup/appendix.md", map[string]interface{}{"title": "Appendix"}),
+		page("docs/setup/upgrade.md", map[string]interface{}{"title": "Upgrade", "weight": 2}),
+	}
+	c.currentFilename = "/site/docs/setup/configure.md"
+	c.pageFm = c.pages[4].fm
+	expected := []menuEntry{
+		{Title: "Example", URL: "/"},
+		{Title: "Docs", URL: "/docs/index.html"},
+		{Title: "Set up", URL: "/docs/setup/README.html"},
+		{Title: "Configure", URL: "/docs/setup/configure.html", Active: true},
+	}
+	if actual := c.breadcrumbItems(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v. Got %v", expected, actual)
+	}
+	if prev, next := c.prevPage(), c.nextPage(); prev == nil || prev.Title != "Install" || next == nil || next.Title != "Upgrade" {
+		t.Errorf("Expected Install and Upgrade. Got %v and %v", prev, next)
+	}
+	// appendix.md has no weight, so it comes last
+	c.currentFilename = "/site/docs/setup/upgrade.md"
+	if next := c.nextPage(); next == nil || next.Title != "Appendix" {
+		t.Errorf("Expected Appendix after the weighted pages. Got %v", next)
+	}
+	c.currentFilename = "/site/docs/setup/appendix.md"
+	if next := c.nextPage(); next != nil {
+		t.Errorf("Expected no page after the last. Got %v", next)
+	}
+	c.currentFilename = "/site/docs/index.md"
+	if prev, next := c.prevPage(), c.nextPage(); prev != nil || next != nil {
+		t.Errorf("Expected no siblings for a section index page. Got %v and %v", prev, next)
+	}
+}
+
+// ********************************************************
+// GIT UTILITIES
+// ********************************************************
+
+func TestParseGitLog(t *testing.T) {
+	log := "\x1eaaa111\x1faaa\x1fAda\x1fada@example.com\x1f2024-05-02T10:00:00+02:00\x1fFix typo\n\ndocs/intro.md\n" +
+		"\x1ebbb222\x1fbbb\x1fGrace\x1fgrace@example.com\x1f2024-04-01T09:30:00Z\x1fFirst draft\n\ndocs/intro.md\nindex.md\n"
+	files := parseGitLog(log)
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 files. Got %v", files)
+	}
+	intro, index := files["docs/intro.md"], files["index.md"]
+	if intro.Hash != "aaa111" || intro.AuthorName != "Ada" || intro.Subject != "Fix typo" ||
+		!intro.Date.Equal(time.Date(2024, 5, 2, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the newest commit for docs/intro.md. Got %+v", intro)
+	}
+	if index.AbbreviatedHash != "bbb" || index.AuthorEmail != "grace@example.com" {
+		t.Errorf("Expected the first draft for index.md. Got %+v", index)
+	}
+}
+
+func TestPageModified(t *testing.T) {
+	lastmod := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		p        pageInfo
+		expected time.Time
+	}{
+		{pageInfo{lastmod: lastmod, fm: map[string]interface{}{"modified": "2024-06-01", "date": "2024-01-01"}}, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{pageInfo{lastmod: lastmod, fm: map[string]interface{}{"date": "2024-01-01"}}, lastmod},
+		{pageInfo{fm: map[string]interface{}{"date": "2024-01-01"}}, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if actual, _ := pageModified(tt.p); !actual.Equal(tt.expected) {
+			t.Errorf("Expected %v. Got %v", tt.expected, actual)
+		}
+	}
+}
+
+// ********************************************************
+// NOT FOUND PAGE
+// ********************************************************
+
+func TestRootRelativeLinks(t *testing.T) {
+	html := `<a href="about.html">About</a><a href="/">Home</a><a href="#top">Top</a>` +
+		`<img src="../img/a.png" srcset="img/a-480.png 480w, img/a.png 960w">` +
+		`<a href="https://example.com/x">X</a><a href="mailto:me@example.com">Me</a>`
+	expected := `<a href="/docs/about.html">About</a><a href="/">Home</a><a href="#top">Top</a>` +
+		`<img src="/img/a.png" srcset="/docs/img/a-480.png 480w, /docs/img/a.png 960w">` +
+		`<a href="https://example.com/x">X</a><a href="mailto:me@example.com">Me</a>`
+	if actual := rootRelativeLinks(html, "/docs/404.html"); actual != expected {
+		t.Errorf("Expected %s. Got %s", expected, actual)
+	}
+}
+
+func TestDevServerNotFound(t *testing.T) {
+	c := newConfig()
+	c.webroot = t.TempDir()
+	c.languages = []string{"en", "fr"}
+	os.WriteFile(filepath.Join(c.webroot, "index.html"), []byte("home"), 0644)
+	os.WriteFile(filepath.Join(c.webroot, "404.html"), []byte("missing"), 0644)
+	os.Mkdir(filepath.Join(c.webroot, "fr"), os.ModePerm)
+	os.WriteFile(filepath.Join(c.webroot, "fr", "404.html"), []byte("introuvable"), 0644)
+	c.pages = []pageInfo{
+		{filename: "404.md", url: "/404.html", lang: "en", key: "404.md"},
+		{filename: "content/fr/404.md", url: "/fr/404.html", lang: "fr", key: "404.md"},
+	}
+	server := httptest.NewServer(c.devServer())
+	defer server.Close()
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "home"},
+		{"/nope/missing.html", http.StatusNotFound, "missing"},
+		{"/fr/missing.html", http.StatusNotFound, "introuvable"},
+	} {
+		resp, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || string(body) != tt.body {
+			t.Errorf("%s: expected %d %s. Got %d %s", tt.path, tt.status, tt.body, resp.StatusCode, body)
+		}
+	}
+}
+
+// ********************************************************
+// REDIRECTS
+// ********************************************************
+
+func TestRedirects(t *testing.T) {
+	c := newConfig()
+	c.pages = []pageInfo{
+		{filename: "index.md", url: "/"},
+		{filename: "docs/install.md", url: "/docs/install.html", fm: map[string]interface{}{
+			"aliases": []interface{}{"/setup/", "install.html", "/old/setup"},
+		}},
+	}
+	expected := []redirect{
+		{From: "/install.html", To: "/docs/install.html", file: "/install.html"},
+		{From: "/old/setup", To: "/docs/install.html", file: "/old/setup/index.html"},
+		{From: "/setup/", To: "/docs/install.html", file: "/setup/index.html"},
+	}
+	actual, err := c.redirects()
+	if err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v. Got %v, %v", expected, actual, err)
+	}
+	rules := "Redirect 301 /install.html /docs/install.html\n" +
+		"Redirect 301 /old/setup /docs/install.html\n" +
+		"Redirect 301 /setup/ /docs/install.html\n"
+	if actual := redirectRules("apache", actual); actual != rules {
+		t.Errorf("Expected %s. Got %s", rules, actual)
+	}
+
+	// Rules are added to the project's own file, replacing
+	// those from an earlier build, but can't contradict it
+	existing := "Options -Indexes\n" + redirectRulesStart + "\nRedirect 301 /gone /\n" + redirectRulesEnd + "\n"
+	merged, err := mergeRedirectRules(existing, "apache", actual)
+	if expected := "Options -Indexes\n" + redirectRulesStart + "\n" + rules + redirectRulesEnd + "\n"; err != nil || merged != expected {
+		t.Errorf("Expected %s. Got %s (%v)", expected, merged, err)
+	}
+	if _, err := mergeRedirectRules("/setup/ /elsewhere 302\n", "netlify", actual); err == nil {
+		t.Errorf("Expected an error for an alias the project already redirects")
+	}
+
+	// An alias can't take over a page's URL or another page's alias
+	c.pages = append(c.pages, pageInfo{filename: "about.md", url: "/about.html", fm: map[string]interface{}{
+		"aliases": []interface{}{"/index.html"},
+	}})
+	if _, err := c.redirects(); err == nil {
+		t.Errorf("Expected an error for an alias of the home page")
+	}
+	c.pages[2].fm["aliases"] = []interface{}{"/setup/index.html"}
+	if _, err := c.redirects(); err == nil {
+		t.Errorf("Expected an error for an alias used twice")
+	}
+}
+
+func TestDevServerRedirects(t *testing.T) {
+	c := newConfig()
+	c.webroot = t.TempDir()
+	c.pages = []pageInfo{
+		{filename: "docs/install.md", url: "/docs/install.html", fm: map[string]interface{}{
+			"aliases": []interface{}{"/setup/"},
+		}},
+	}
+	server := httptest.NewServer(c.devServer())
+	defer server.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, p := range []string{"/setup/", "/setup", "/setup/index.html"} {
+		resp, err := client.Get(server.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/docs/install.html" {
+			t.Errorf("%s: expected a redirect to /docs/install.html. Got %d %s", p, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+}
+
 // ********************************************************
 // SEARCHINFO UTILITIES
 // ********************************************************
@@ -465,6 +1676,60 @@ func TestGetTmpTests(t *testing.T) {
 	}
 }
 
+// ********************************************************
+// LINEDIFF
+// ********************************************************
+
+var lineDiffTests = []struct {
+	before   string
+	after    string
+	expected string
+}{
+
+	// TEST RECORD
+	{
+		// Identical files produce no differences
+		"a\nb\nc",
+		"a\nb\nc",
+		"",
+	},
+
+	// TEST RECORD
+	{
+		// One line changed in the middle
+		"a\nb\nc",
+		"a\nB\nc",
+		"-b\n+B\n",
+	},
+
+	// TEST RECORD
+	{
+		// Line added at the end
+		"a\nb",
+		"a\nb\nc",
+		"+c\n",
+	},
+}
+
+func TestLineDiff(t *testing.T) {
+	for _, tt := range lineDiffTests {
+		actual := lineDiff(tt.before, tt.after)
+		if actual != tt.expected {
+			t.Errorf("lineDiff(%q, %q): expected %q. Got %q",
+				tt.before, tt.after, tt.expected, actual)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	if !isText([]byte("body{color:red;}\n")) {
+		t.Errorf("Expected CSS to be text")
+	}
+	if isText([]byte("\xff\xd8\xff\xe0\x00\x10JFIF")) {
+		t.Errorf("Expected a JPEG header not to be text")
+	}
+}
+
 // ********************************************************
 // UTILITIES
 // ********************************************************